@@ -0,0 +1,140 @@
+// Package apikey issues store API keys and authenticates requests made with
+// them. Only a SHA-256 hash of each key is stored, along with a short prefix
+// that identifies the key without revealing it
+package apikey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// Prefix starts every key, so a leaked key is easy to recognise
+const Prefix = "bbl_"
+
+// PrefixLength is how much of a key is stored and shown to identify it
+const PrefixLength = len(Prefix) + 8
+
+// secretSize is the number of random bytes in a key
+const secretSize = 24
+
+// touchInterval limits how often last_used_at is written for a busy key
+const touchInterval = time.Minute
+
+// ErrInvalid is returned for a key that is unknown, revoked or expired, or
+// that belongs to a store that is not active
+var ErrInvalid = errors.New("apikey: invalid API key")
+
+// Queryer is satisfied by both *sql.DB and *sql.Tx
+type Queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Key describes an issued key, without the key itself
+type Key struct {
+	ID         int        `json:"id"`
+	Prefix     string     `json:"prefix"`
+	Label      string     `json:"label"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	ExpireAt   *time.Time `json:"expireAt,omitempty"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+}
+
+// GenerateIssueKeyQuery stores a new key for a store
+func GenerateIssueKeyQuery() string {
+	return "INSERT INTO api_keys (store_id, prefix, key_hash, label, expire_at) VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at"
+}
+
+// GenerateAuthenticateQuery finds the active store of a usable key by its hash
+func GenerateAuthenticateQuery() string {
+	return "SELECT api_keys.id, api_keys.last_used_at, stores.id, stores.name from api_keys join stores on api_keys.store_id = stores.id WHERE api_keys.key_hash = $1 AND api_keys.revoked_at IS NULL AND (api_keys.expire_at IS NULL OR current_timestamp < api_keys.expire_at) AND stores.status = 'ACTIVE'"
+}
+
+// GenerateTouchKeyQuery records that a key was used
+func GenerateTouchKeyQuery() string {
+	return "UPDATE api_keys SET last_used_at = now() WHERE id = $1"
+}
+
+// Hash is how a key is stored and looked up
+func Hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Visible is the part of a key that may be stored, logged and shown
+func Visible(key string) string {
+	if len(key) <= PrefixLength {
+		return key
+	}
+	return key[:PrefixLength]
+}
+
+// Generate creates a random key
+func Generate() (string, error) {
+	secret := make([]byte, secretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return Prefix + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// Issue generates and stores a new key for a store. The key itself is only
+// ever returned here
+func Issue(q Queryer, storeID int, label string, expireAt sql.NullTime) (Key, string, error) {
+	key, err := Generate()
+	if err != nil {
+		return Key{}, "", err
+	}
+
+	issued := Key{Prefix: Visible(key), Label: label}
+	if expireAt.Valid {
+		issued.ExpireAt = &expireAt.Time
+	}
+	row := q.QueryRow(GenerateIssueKeyQuery(), storeID, issued.Prefix, Hash(key), label, expireAt)
+	if err = row.Scan(&issued.ID, &issued.CreatedAt); err != nil {
+		return Key{}, "", err
+	}
+	return issued, key, nil
+}
+
+// Caller is the store a request was made for and the key it was made with
+type Caller struct {
+	KeyID     int
+	StoreID   int
+	StoreName string
+}
+
+// Identify finds the store and key a request was made with, returning
+// ErrInvalid when the key can't be used, and records when the key was last
+// used
+func Identify(q Queryer, key string) (Caller, error) {
+	var caller Caller
+	var lastUsedAt sql.NullTime
+	row := q.QueryRow(GenerateAuthenticateQuery(), Hash(key))
+	switch err := row.Scan(&caller.KeyID, &lastUsedAt, &caller.StoreID, &caller.StoreName); err {
+	case sql.ErrNoRows:
+		return Caller{}, ErrInvalid
+	case nil:
+	default:
+		return Caller{}, err
+	}
+
+	if !lastUsedAt.Valid || time.Since(lastUsedAt.Time) > touchInterval {
+		if _, err := q.Exec(GenerateTouchKeyQuery(), caller.KeyID); err != nil {
+			return Caller{}, err
+		}
+	}
+	return caller, nil
+}
+
+// Authenticate finds the store a key belongs to, as Identify does
+func Authenticate(q Queryer, key string) (int, string, error) {
+	caller, err := Identify(q, key)
+	return caller.StoreID, caller.StoreName, err
+}
@@ -0,0 +1,68 @@
+package apikey
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		key, err := Generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(key, Prefix) {
+			t.Errorf("Generate = %q, want prefix %q", key, Prefix)
+		}
+		if len(key) <= PrefixLength {
+			t.Errorf("Generate = %q, want more than the %d characters of its visible prefix", key, PrefixLength)
+		}
+		if seen[key] {
+			t.Errorf("Generate gave %q twice", key)
+		}
+		seen[key] = true
+	}
+}
+
+func TestHash(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{"abc", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+	}
+
+	for _, tt := range tests {
+		got := Hash(tt.key)
+		if got != tt.want {
+			t.Errorf("Hash(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+		if _, err := hex.DecodeString(got); err != nil || len(got) != 64 {
+			t.Errorf("Hash(%q) = %q, want 64 hex characters", tt.key, got)
+		}
+	}
+	if Hash("bbl_abc") == Hash("bbl_abd") {
+		t.Error("Hash gave the same hash for different keys")
+	}
+}
+
+func TestVisible(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"bbl_abcdefghijklmnop", "bbl_abcdefgh"},
+		{"bbl_abcdefgh", "bbl_abcdefgh"},
+		{"bbl_abc", "bbl_abc"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := Visible(tt.key); got != tt.want {
+			t.Errorf("Visible(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
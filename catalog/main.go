@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/addauda/bubble-rewards-storefront-api/apikey"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	_ "github.com/lib/pq"
+)
+
+// Response is of type APIGatewayProxyResponse since we're leveraging the
+// AWS Lambda Proxy Request functionality (default behavior)
+//
+// https://serverless.com/framework/docs/providers/aws/events/apigateway/#lambda-proxy-integration
+type Response events.APIGatewayProxyResponse
+
+const expiration = time.Hour
+
+// defaultLimit and maxLimit bound how many entries a search returns
+const (
+	defaultLimit = 50
+	maxLimit     = 200
+)
+
+var client = &http.Client{}
+
+// catalogs maps the last part of the path to the table it lists
+var catalogs = map[string]string{
+	"rewards": "rewards",
+	"actions": "actions",
+}
+
+// EntryRequest is the body of a new reward or action
+type EntryRequest struct {
+	Description string `json:"description"`
+	Keywords    string `json:"keywords"`
+}
+
+// Entry is a reward or action in the catalog
+type Entry struct {
+	ID          string    `json:"id"`
+	Description string    `json:"description"`
+	Keywords    string    `json:"keywords,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// Catalog is a list of rewards or actions, best match first when searched
+type Catalog struct {
+	Entries []Entry `json:"entries"`
+}
+
+// GenerateCatalogQuery lists the entries of a catalog table matching the
+// search $1, or all of them when it is null. The search document matches the
+// expression index on the table
+func GenerateCatalogQuery(table string) string {
+	return fmt.Sprintf("SELECT id, description, keywords, created_at from %s WHERE $1::text IS NULL OR to_tsvector('english', description || ' ' || COALESCE(keywords, '')) @@ websearch_to_tsquery('english', $1) ORDER BY CASE WHEN $1::text IS NULL THEN 0 ELSE ts_rank(to_tsvector('english', description || ' ' || COALESCE(keywords, '')), websearch_to_tsquery('english', $1)) END DESC, id LIMIT $2", table)
+}
+
+// GenerateCreateEntryQuery adds an entry to a catalog table
+func GenerateCreateEntryQuery(table string) string {
+	return fmt.Sprintf("INSERT INTO %s (description, keywords) VALUES ($1, $2) RETURNING id, description, keywords, created_at", table)
+}
+
+// scanner is satisfied by both *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanEntry reads an entry from a catalog row
+func scanEntry(row scanner) (Entry, error) {
+	var entry Entry
+	var keywords sql.NullString
+	err := row.Scan(&entry.ID, &entry.Description, &keywords, &entry.CreatedAt)
+	entry.Keywords = keywords.String
+	return entry, err
+}
+
+// search lists a catalog's entries, narrowed down by a full text search
+func search(db *sql.DB, table string, query sql.NullString, limit int) (Catalog, error) {
+	catalog := Catalog{Entries: []Entry{}}
+	rows, err := db.Query(GenerateCatalogQuery(table), query, limit)
+	if err != nil {
+		return catalog, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry, err := scanEntry(rows)
+		if err != nil {
+			return catalog, err
+		}
+		catalog.Entries = append(catalog.Entries, entry)
+	}
+	return catalog, rows.Err()
+}
+
+// errorResponse builds an error response with a machine readable error code
+func errorResponse(statusCode int, code string, message string) Response {
+	return Response{StatusCode: statusCode,
+		Body: fmt.Sprintf(" { \"error\" : \"%s\", \"message\" : \"%s\" } ", code, message),
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin":      "*",
+			"Access-Control-Allow-Credentials": "true",
+		},
+	}
+}
+
+// Handler is our lambda handler invoked by the `lambda.Start` function call.
+// GET lists or searches the rewards or actions catalog and POST adds to it
+func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (Response, error) {
+
+	apiKey := request.QueryStringParameters["api_key"]
+	table := catalogs[request.Path[strings.LastIndex(request.Path, "/")+1:]]
+	method := request.HTTPMethod
+
+	// Ensure all fields are not empty
+	if apiKey != "" && table != "" && (method == "GET" || method == "POST") {
+
+		log.Printf("Info: Request catalog %s", table)
+		log.Printf("Info: Request method %s", method)
+		log.Printf("Info: Request API key %s", apikey.Visible(apiKey))
+
+		// A blank description would add an entry nothing can match
+		var entry EntryRequest
+		var query sql.NullString
+		limit := defaultLimit
+		if method == "GET" {
+			if q := strings.TrimSpace(request.QueryStringParameters["q"]); q != "" {
+				log.Printf("Info: Request search %s", q)
+				query = sql.NullString{String: q, Valid: true}
+			}
+			if l := request.QueryStringParameters["limit"]; l != "" {
+				var err error
+				if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > maxLimit {
+					return errorResponse(400, "INVALID_REQUEST", fmt.Sprintf("limit must be between 1 and %d", maxLimit)), nil
+				}
+			}
+		} else {
+			if err := json.Unmarshal([]byte(request.Body), &entry); err != nil {
+				log.Printf("Error: Malformed request body: %v", err)
+				return errorResponse(400, "INVALID_REQUEST", "Malformed request body"), nil
+			}
+			entry.Description = strings.TrimSpace(entry.Description)
+			if entry.Description == "" {
+				return errorResponse(400, "INVALID_REQUEST", "A description is required"), nil
+			}
+		}
+
+		// Connect to database
+		connStr := fmt.Sprintf("host=%s user=%s password=%s dbname=%s sslmode=disable",
+			os.Getenv("DB_HOST"), os.Getenv("DB_USER"), os.Getenv("DB_PASSWORD"), os.Getenv("DB_NAME"))
+
+		db, err := sql.Open("postgres", connStr)
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		defer db.Close()
+
+		// Validate API key
+		_, storeName, err := apikey.Authenticate(db, apiKey)
+		switch err {
+		case apikey.ErrInvalid:
+			log.Printf("Error: No store with API key [%s] was found", apikey.Visible(apiKey))
+			return Response{StatusCode: 401,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		case nil:
+			log.Printf("Info: Retreived store as [%s]", storeName)
+		default:
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		var result interface{}
+		if method == "GET" {
+			result, err = search(db, table, query, limit)
+		} else {
+			keywords := sql.NullString{String: strings.TrimSpace(entry.Keywords), Valid: strings.TrimSpace(entry.Keywords) != ""}
+			result, err = scanEntry(db.QueryRow(GenerateCreateEntryQuery(table), entry.Description, keywords))
+			if err == nil {
+				log.Printf("Success: Store [%s] added [%s] to %s", storeName, entry.Description, table)
+			}
+		}
+
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		//Generate message that want to be sent as body
+		message, err := json.Marshal(result)
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		//Returning response with AWS Lambda Proxy Response
+		return Response{StatusCode: 200,
+			Body: string(message),
+			Headers: map[string]string{
+				"Access-Control-Allow-Origin":      "*",
+				"Access-Control-Allow-Credentials": "true",
+			},
+		}, nil
+	}
+
+	// Missing one of required parameters
+	log.Printf("Error: Request missing a required parameter")
+	return Response{StatusCode: 400,
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin":      "*",
+			"Access-Control-Allow-Credentials": "true",
+		},
+	}, nil
+}
+
+type LocalServer struct{}
+
+func (l *LocalServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("Error reading request body: %v", err)
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("Failed to write body: %v", err)))
+		return
+	}
+
+	url, err := url.Parse(r.URL.String())
+	if err != nil {
+		log.Printf("Error parsing query string: %v", err)
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("Malformed query string: %v", err)))
+		return
+	}
+	queryParams := url.Query()
+
+	//**building request**
+	req := events.APIGatewayProxyRequest{
+		Body:                  string(body),
+		Headers:               make(map[string]string),
+		HTTPMethod:            r.Method,
+		Path:                  r.URL.Path,
+		QueryStringParameters: make(map[string]string),
+	}
+
+	//map raw request headers
+	for k, v := range r.Header {
+		req.Headers[strings.ToLower(k)] = v[0]
+	}
+
+	//Map raw query params
+	for k, v := range queryParams {
+		req.QueryStringParameters[strings.ToLower(k)] = v[0]
+	}
+
+	resp, err := Handler(r.Context(), req)
+	if err != nil {
+		log.Printf("Error handling request: %v", err)
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("Error handling request: %v", err)))
+		return
+	}
+	for k, v := range resp.Headers {
+		w.Header().Add(k, v)
+	}
+	(w).Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(resp.StatusCode)
+	w.Write([]byte(resp.Body))
+}
+
+func local() {
+	server := &LocalServer{}
+	fmt.Println("Starting local dev server on :8080")
+	http.ListenAndServe(":8080", server)
+}
+
+func main() {
+	if os.Getenv("AWS_LAMBDA_FUNCTION_NAME") == "" {
+		//see local creds file for env vars
+		local()
+	} else {
+		// Make the handler available for Remote Procedure Call by AWS Lambda
+		lambda.Start(Handler)
+	}
+}
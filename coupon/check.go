@@ -0,0 +1,77 @@
+package coupon
+
+import "strings"
+
+// LegacyLength is the length of codes issued before they carried a check
+// character. They are looked up without being checked
+const LegacyLength = 4
+
+// LegacyAlphabet is the upper case hex that legacy codes were drawn from
+const LegacyAlphabet = "0123456789ABCDEF"
+
+// checkCharacter computes the Luhn mod N check character over Alphabet for
+// the given payload
+func checkCharacter(payload string) byte {
+	n := len(Alphabet)
+	factor := 2
+	sum := 0
+	for i := len(payload) - 1; i >= 0; i-- {
+		addend := factor * strings.IndexByte(Alphabet, payload[i])
+		if factor == 2 {
+			factor = 1
+		} else {
+			factor = 2
+		}
+		sum += addend/n + addend%n
+	}
+	return Alphabet[(n-sum%n)%n]
+}
+
+// Valid reports whether a normalized code is made up of Alphabet and ends in
+// the right check character
+func Valid(code string) bool {
+	if len(code) < 2 {
+		return false
+	}
+	for i := 0; i < len(code); i++ {
+		if strings.IndexByte(Alphabet, code[i]) < 0 {
+			return false
+		}
+	}
+	return checkCharacter(code[:len(code)-1]) == code[len(code)-1]
+}
+
+// Checked reports whether a normalized code is expected to carry a check
+// character, which every code but legacy ones does. A legacy code is
+// LegacyLength characters of LegacyAlphabet
+func Checked(code string) bool {
+	if len(code) != LegacyLength {
+		return true
+	}
+	for i := 0; i < len(code); i++ {
+		if strings.IndexByte(LegacyAlphabet, code[i]) < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Suggest looks for the code a cashier most likely meant by swapping each
+// pair of adjacent characters. It only suggests a code when exactly one
+// swap gives a valid code
+func Suggest(code string) (string, bool) {
+	suggestion := ""
+	found := 0
+	for i := 0; i+1 < len(code); i++ {
+		if code[i] == code[i+1] {
+			continue
+		}
+		swapped := []byte(code)
+		swapped[i], swapped[i+1] = swapped[i+1], swapped[i]
+		if Valid(string(swapped)) {
+			suggestion = string(swapped)
+			found++
+		}
+	}
+	return suggestion, found == 1
+}
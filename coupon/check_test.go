@@ -0,0 +1,75 @@
+package coupon
+
+import "testing"
+
+func TestValid(t *testing.T) {
+	tests := []struct {
+		code string
+		want bool
+	}{
+		{"ABCDEJ", true},
+		{"23456J", true},
+		{"PQRST7", true},
+		{"ABCDEK", false},
+		{"ACBDEJ", false},
+		{"ABCDE", false},
+		{"ABCD0J", false},
+		{"abcdej", false},
+		{"J", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := Valid(tt.code); got != tt.want {
+			t.Errorf("Valid(%q) = %v, want %v", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestChecked(t *testing.T) {
+	tests := []struct {
+		code string
+		want bool
+	}{
+		{"A1F0", false},
+		{"0000", false},
+		{"BEEF", false},
+		{"A1G0", true},
+		{"ABC", true},
+		{"A1F00", true},
+		{"ABCDEJ", true},
+	}
+
+	for _, tt := range tests {
+		if got := Checked(tt.code); got != tt.want {
+			t.Errorf("Checked(%q) = %v, want %v", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+		ok   bool
+	}{
+		// One adjacent swap gives a valid code
+		{"ACBDEJ", "ABCDEJ", true},
+		{"ABCDJE", "ABCDEJ", true},
+		{"HJKNMM", "HJKMNM", true},
+		{"73FK9A", "7F3K9A", true},
+		// More than one swap gives a valid code, so none is suggested
+		{"ABCEDJ", "", false},
+		{"PQRTS7", "", false},
+		// Nothing to swap
+		{"AAAAAA", "", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := Suggest(tt.code)
+		if ok != tt.ok || ok && got != tt.want {
+			t.Errorf("Suggest(%q) = %q, %v, want %q, %v", tt.code, got, ok, tt.want, tt.ok)
+		}
+	}
+}
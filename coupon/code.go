@@ -0,0 +1,109 @@
+// Package coupon generates coupon codes that are easy to read aloud and to
+// type into a POS, and issues coupons carrying them.
+package coupon
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Alphabet leaves out characters that are easily confused with others (0/O
+// and 1/I)
+const Alphabet = "23456789ABCDEFGHJKLMNPQRSTUVWXYZ"
+
+// DefaultLength applies when COUPON_CODE_LENGTH is not set
+const DefaultLength = 6
+
+// MinLength and MaxLength bound the configurable code length, including the
+// check character. MaxLength matches the width of redemptions_coupon.code
+const (
+	MinLength = 5
+	MaxLength = 16
+)
+
+// maxAttempts is how many codes Issue tries before giving up
+const maxAttempts = 5
+
+// ErrExhausted is returned when every generated code collided with an active
+// coupon
+var ErrExhausted = errors.New("coupon: could not generate a unique code")
+
+// Queryer is satisfied by both *sql.DB and *sql.Tx
+type Queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Coupon is a newly issued coupon
+type Coupon struct {
+	ID       int       `json:"id"`
+	Code     string    `json:"code"`
+	ExpireAt time.Time `json:"expireAt"`
+	MaxUses  int       `json:"maxUses"`
+}
+
+// GenerateInsertCouponQuery inserts a coupon valid for as long and for as many
+// uses as the submission's offer says, unless its code is already held by an
+// active coupon
+func GenerateInsertCouponQuery() string {
+	return "INSERT INTO redemptions_coupon (code, submission_id, expire_at, max_uses) SELECT $1, submissions.id, current_timestamp + offers.coupon_validity, offers.coupon_uses from submissions join offers on submissions.offer_id = offers.id WHERE submissions.id = $2 ON CONFLICT (code) WHERE status = 'PENDING' DO NOTHING RETURNING id, expire_at, max_uses"
+}
+
+// Length reads the configured code length from COUPON_CODE_LENGTH
+func Length() int {
+	length, err := strconv.Atoi(os.Getenv("COUPON_CODE_LENGTH"))
+	if err != nil || length < MinLength || length > MaxLength {
+		return DefaultLength
+	}
+	return length
+}
+
+// NewCode generates a random code of the given length from Alphabet, the
+// last character of which is a check character
+func NewCode(length int) (string, error) {
+	code := make([]byte, length)
+	max := big.NewInt(int64(len(Alphabet)))
+	for i := 0; i < length-1; i++ {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = Alphabet[n.Int64()]
+	}
+	code[length-1] = checkCharacter(string(code[:length-1]))
+	return string(code), nil
+}
+
+// Normalize tidies a code as typed by a cashier before it is looked up
+func Normalize(code string) string {
+	code = strings.ToUpper(code)
+	return strings.NewReplacer(" ", "", "-", "").Replace(code)
+}
+
+// Issue creates a coupon for the submission, generating a fresh code
+// whenever the previous one collides with an active coupon
+func Issue(q Queryer, submissionID int) (Coupon, error) {
+	length := Length()
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		code, err := NewCode(length)
+		if err != nil {
+			return Coupon{}, err
+		}
+
+		issued := Coupon{Code: code}
+		switch err = q.QueryRow(GenerateInsertCouponQuery(), code, submissionID).Scan(&issued.ID, &issued.ExpireAt, &issued.MaxUses); err {
+		case sql.ErrNoRows:
+			continue
+		case nil:
+			return issued, nil
+		default:
+			return Coupon{}, err
+		}
+	}
+	return Coupon{}, ErrExhausted
+}
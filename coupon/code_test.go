@@ -0,0 +1,79 @@
+package coupon
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestNewCode(t *testing.T) {
+	for _, length := range []int{MinLength, DefaultLength, MaxLength} {
+		code, err := NewCode(length)
+		if err != nil {
+			t.Fatalf("NewCode(%d): %v", length, err)
+		}
+		if len(code) != length {
+			t.Errorf("NewCode(%d) = %q, want %d characters", length, code, length)
+		}
+		for i := 0; i < len(code); i++ {
+			if !strings.ContainsRune(Alphabet, rune(code[i])) {
+				t.Errorf("NewCode(%d) = %q, %q is not in Alphabet", length, code, code[i])
+			}
+		}
+		if !Valid(code) {
+			t.Errorf("NewCode(%d) = %q, which fails its own check character", length, code)
+		}
+	}
+}
+
+func TestAlphabetLeavesOutLookalikes(t *testing.T) {
+	for _, c := range "01IO" {
+		if strings.ContainsRune(Alphabet, c) {
+			t.Errorf("Alphabet contains %q", c)
+		}
+	}
+}
+
+func TestLength(t *testing.T) {
+	tests := []struct {
+		env  string
+		want int
+	}{
+		{"", DefaultLength},
+		{"abc", DefaultLength},
+		{strconv.Itoa(MinLength - 1), DefaultLength},
+		{strconv.Itoa(MinLength), MinLength},
+		{"8", 8},
+		{strconv.Itoa(MaxLength), MaxLength},
+		{strconv.Itoa(MaxLength + 1), DefaultLength},
+	}
+
+	defer os.Setenv("COUPON_CODE_LENGTH", os.Getenv("COUPON_CODE_LENGTH"))
+	for _, tt := range tests {
+		os.Setenv("COUPON_CODE_LENGTH", tt.env)
+		if got := Length(); got != tt.want {
+			t.Errorf("Length() with COUPON_CODE_LENGTH=%q = %d, want %d", tt.env, got, tt.want)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{"ABCDEJ", "ABCDEJ"},
+		{"abcdej", "ABCDEJ"},
+		{"abc-dej", "ABCDEJ"},
+		{" ABC DEJ ", "ABCDEJ"},
+		{"a-b c-d", "ABCD"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := Normalize(tt.code); got != tt.want {
+			t.Errorf("Normalize(%q) = %q, want %q", tt.code, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+package coupon
+
+import "strings"
+
+// PayloadPrefix marks a scanned QR payload as carrying a coupon code. QR codes
+// are now rendered as signed tokens, but ones printed before still carry it
+const PayloadPrefix = "BUBBLE:"
+
+// ParsePayload extracts the coupon code from a scanned QR payload
+func ParsePayload(payload string) (string, bool) {
+	payload = strings.TrimSpace(payload)
+	if !strings.HasPrefix(strings.ToUpper(payload), PayloadPrefix) {
+		return "", false
+	}
+	return payload[len(PayloadPrefix):], true
+}
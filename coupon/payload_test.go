@@ -0,0 +1,27 @@
+package coupon
+
+import "testing"
+
+func TestParsePayload(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    string
+		ok      bool
+	}{
+		{"BUBBLE:ABCDEJ", "ABCDEJ", true},
+		{"bubble:ABCDEJ", "ABCDEJ", true},
+		{"  BUBBLE:A1F0\n", "A1F0", true},
+		{"BUBBLE:", "", true},
+		{"ABCDEJ", "", false},
+		{"BT.k1.claims.signature", "", false},
+		{"BUBBLE", "", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := ParsePayload(tt.payload)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("ParsePayload(%q) = %q, %v, want %q, %v", tt.payload, got, ok, tt.want, tt.ok)
+		}
+	}
+}
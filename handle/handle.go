@@ -0,0 +1,39 @@
+// Package handle normalizes Instagram handles to the canonical form they are
+// stored and looked up in: a leading @ followed by the lowercased username
+package handle
+
+import (
+	"errors"
+	"strings"
+)
+
+// MaxLength is the longest username Instagram allows, not counting the @
+const MaxLength = 30
+
+// Whitespace is what is trimmed from either end of a handle. It is ASCII only
+// so that Postgres' btrim in normalize_instagram_handle trims the same set;
+// anything else, e.g. a non-breaking space, makes the handle invalid
+const Whitespace = " \t\n\r\v\f"
+
+// ErrInvalid is returned for a handle that can't be an Instagram username
+var ErrInvalid = errors.New("handle: invalid instagram handle")
+
+// Normalize trims a handle, drops any leading @ and lowercases it, then checks
+// it against Instagram's rules: letters, digits, underscores and periods, no
+// period at either end or twice in a row. Keep in sync with
+// normalize_instagram_handle in the schema
+func Normalize(handle string) (string, error) {
+	username := strings.ToLower(strings.TrimPrefix(strings.Trim(handle, Whitespace), "@"))
+	if username == "" || len(username) > MaxLength {
+		return "", ErrInvalid
+	}
+	if strings.HasPrefix(username, ".") || strings.HasSuffix(username, ".") || strings.Contains(username, "..") {
+		return "", ErrInvalid
+	}
+	for _, r := range username {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' || r == '.') {
+			return "", ErrInvalid
+		}
+	}
+	return "@" + username, nil
+}
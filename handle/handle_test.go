@@ -0,0 +1,44 @@
+package handle
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		handle  string
+		want    string
+		wantErr error
+	}{
+		{"bubbletea", "@bubbletea", nil},
+		{"@BubbleTea", "@bubbletea", nil},
+		{"  @bubble.tea_2 ", "@bubble.tea_2", nil},
+		{"\t@bubble\r\n", "@bubble", nil},
+		{"\v\f@bubble", "@bubble", nil},
+		{"a", "@a", nil},
+		{"_", "@_", nil},
+		{strings.Repeat("a", MaxLength), "@" + strings.Repeat("a", MaxLength), nil},
+		{"@" + strings.Repeat("a", MaxLength), "@" + strings.Repeat("a", MaxLength), nil},
+		{strings.Repeat("a", MaxLength+1), "", ErrInvalid},
+		{"", "", ErrInvalid},
+		{"@", "", ErrInvalid},
+		{"   ", "", ErrInvalid},
+		{"@@bubble", "", ErrInvalid},
+		{".bubble", "", ErrInvalid},
+		{"bubble.", "", ErrInvalid},
+		{"bubble..tea", "", ErrInvalid},
+		{"bubble tea", "", ErrInvalid},
+		{"bubble-tea", "", ErrInvalid},
+		{"bubblé", "", ErrInvalid},
+		{" bubble", "", ErrInvalid},
+		{"bubble ", "", ErrInvalid},
+	}
+
+	for _, tt := range tests {
+		got, err := Normalize(tt.handle)
+		if got != tt.want || err != tt.wantErr {
+			t.Errorf("Normalize(%q) = %q, %v, want %q, %v", tt.handle, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/addauda/bubble-rewards-storefront-api/apikey"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 )
@@ -33,7 +34,7 @@ func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (Respon
 	// Ensure all fields are not empty
 	if apiKey != "" {
 
-		log.Printf("Info: Request API key %s", apiKey)
+		log.Printf("Info: Request API key %s", apikey.Visible(apiKey))
 
 		message := fmt.Sprintf(" { \"status\" : \"%s\" } ", "success")
 
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/addauda/bubble-rewards-storefront-api/apikey"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	_ "github.com/lib/pq"
+)
+
+// Response is of type APIGatewayProxyResponse since we're leveraging the
+// AWS Lambda Proxy Request functionality (default behavior)
+//
+// https://serverless.com/framework/docs/providers/aws/events/apigateway/#lambda-proxy-integration
+type Response events.APIGatewayProxyResponse
+
+const expiration = time.Hour
+
+// defaultLimit and maxLimit bound how many entries a page holds
+const (
+	defaultLimit = 50
+	maxLimit     = 200
+)
+
+var client = &http.Client{}
+
+// Entry is a single redemption in a store's history. Voided redemptions are
+// listed with a status of VOIDED
+type Entry struct {
+	RedemptionType    string     `json:"redemptionType"`
+	ID                string     `json:"id"`
+	Code              string     `json:"code,omitempty"`
+	Status            string     `json:"status"`
+	RedeemedAt        time.Time  `json:"redeemedAt"`
+	VoidedAt          *time.Time `json:"voidedAt,omitempty"`
+	RewardDescription string     `json:"rewardDescription"`
+	TierName          string     `json:"tierName,omitempty"`
+	InstagramAccount  string     `json:"instagramAccount"`
+	OfferID           string     `json:"offerId"`
+	DeviceID          string     `json:"deviceId,omitempty"`
+}
+
+// History is a page of a store's redemption history, newest first
+type History struct {
+	StoreName  string  `json:"storeName"`
+	Entries    []Entry `json:"entries"`
+	NextCursor string  `json:"nextCursor,omitempty"`
+}
+
+// Filter narrows down a store's history, unset fields match everything
+type Filter struct {
+	From           sql.NullTime
+	To             sql.NullTime
+	RedemptionType sql.NullString
+	OfferID        sql.NullInt64
+	Status         sql.NullString
+	Limit          int
+
+	// The cursor is the position of the last entry of the previous page
+	AfterTime  sql.NullTime
+	AfterEntry sql.NullString
+}
+
+// GenerateHistoryQuery lists a store's coupon uses, instant redemptions and
+// voids, newest first. entry_id tells apart entries redeemed at the same time
+func GenerateHistoryQuery() string {
+	return "SELECT redemption_type, id, code, status, redeemed_at, voided_at, description, tier_name, instagram_account, offer_id, device_id, entry_id from (" +
+		"SELECT 'COUPON' AS redemption_type, redemptions_coupon.id, redemptions_coupon.code, 'REDEEMED' AS status, redemptions_coupon_uses.redeemed_at, NULL::timestamptz AS voided_at, rewards.description, submissions.tier_name, submissions.instagram_account, offers.id AS offer_id, offers.store_id, redemptions_coupon_uses.device_id, 'C' || redemptions_coupon_uses.id AS entry_id from redemptions_coupon_uses join redemptions_coupon on redemptions_coupon_uses.coupon_id = redemptions_coupon.id join submissions on redemptions_coupon.submission_id = submissions.id join offers on submissions.offer_id = offers.id join rewards on submissions.loyalty_reward_id = rewards.id " +
+		"UNION ALL SELECT 'INSTANT', submissions.id, NULL, 'REDEEMED', redemptions_instant.redeemed_at, NULL, rewards.description, submissions.tier_name, submissions.instagram_account, offers.id, offers.store_id, redemptions_instant.device_id, 'I' || redemptions_instant.id from redemptions_instant join submissions on redemptions_instant.submission_id = submissions.id join offers on submissions.offer_id = offers.id join rewards on submissions.instant_reward_id = rewards.id WHERE redemptions_instant.redeemed_at IS NOT NULL " +
+		"UNION ALL SELECT redemption_voids.redemption_type, COALESCE(redemption_voids.coupon_id, redemption_voids.submission_id), redemptions_coupon.code, 'VOIDED', redemption_voids.redeemed_at, redemption_voids.voided_at, rewards.description, submissions.tier_name, submissions.instagram_account, offers.id, redemption_voids.store_id, NULL, 'V' || redemption_voids.id from redemption_voids left join redemptions_coupon on redemption_voids.coupon_id = redemptions_coupon.id join submissions on redemption_voids.submission_id = submissions.id join offers on submissions.offer_id = offers.id join rewards on rewards.id = CASE WHEN redemption_voids.redemption_type = 'COUPON' THEN submissions.loyalty_reward_id ELSE submissions.instant_reward_id END WHERE redemption_voids.redeemed_at IS NOT NULL" +
+		") history WHERE store_id = $1 AND ($2::timestamptz IS NULL OR redeemed_at >= $2) AND ($3::timestamptz IS NULL OR redeemed_at < $3) AND ($4::text IS NULL OR redemption_type = $4) AND ($5::integer IS NULL OR offer_id = $5) AND ($6::text IS NULL OR status = $6) AND ($7::timestamptz IS NULL OR (redeemed_at, entry_id) < ($7, $8::text)) " +
+		"ORDER BY redeemed_at DESC, entry_id DESC LIMIT $9"
+}
+
+// encodeCursor makes an opaque cursor from the last entry of a page
+func encodeCursor(redeemedAt time.Time, entryID string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(redeemedAt.UTC().Format(time.RFC3339Nano) + "," + entryID))
+}
+
+// decodeCursor reads back the position a cursor was made from
+func decodeCursor(cursor string) (time.Time, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	parts := strings.SplitN(string(raw), ",", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return time.Time{}, "", errors.New("malformed cursor")
+	}
+	redeemedAt, err := time.Parse(time.RFC3339Nano, parts[0])
+	return redeemedAt, parts[1], err
+}
+
+// parseTime reads a bound of the date range, either an RFC 3339 time or a
+// date. A date as the upper bound includes the whole day
+func parseTime(value string, upper bool) (sql.NullTime, error) {
+	if value == "" {
+		return sql.NullTime{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return sql.NullTime{Time: t, Valid: true}, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return sql.NullTime{}, err
+	}
+	if upper {
+		t = t.AddDate(0, 0, 1)
+	}
+	return sql.NullTime{Time: t, Valid: true}, nil
+}
+
+// parseFilter reads the filters and cursor from the query string. Errors name
+// the parameter but leave out its value, as they are sent back as the message
+func parseFilter(params map[string]string) (Filter, error) {
+	var filter Filter
+	var err error
+	if filter.From, err = parseTime(params["from"], false); err != nil {
+		return filter, errors.New("invalid from")
+	}
+	if filter.To, err = parseTime(params["to"], true); err != nil {
+		return filter, errors.New("invalid to")
+	}
+
+	if t := params["redemption_type"]; t != "" {
+		if t != "COUPON" && t != "INSTANT" {
+			return filter, errors.New("invalid redemption type")
+		}
+		filter.RedemptionType = sql.NullString{String: t, Valid: true}
+	}
+
+	if o := params["offer_id"]; o != "" {
+		offerID, err := strconv.ParseInt(o, 10, 32)
+		if err != nil {
+			return filter, errors.New("invalid offer id")
+		}
+		filter.OfferID = sql.NullInt64{Int64: offerID, Valid: true}
+	}
+
+	if s := params["status"]; s != "" {
+		if s != "REDEEMED" && s != "VOIDED" {
+			return filter, errors.New("invalid status")
+		}
+		filter.Status = sql.NullString{String: s, Valid: true}
+	}
+
+	filter.Limit = defaultLimit
+	if l := params["limit"]; l != "" {
+		if filter.Limit, err = strconv.Atoi(l); err != nil || filter.Limit < 1 || filter.Limit > maxLimit {
+			return filter, errors.New("invalid limit")
+		}
+	}
+
+	if c := params["cursor"]; c != "" {
+		afterTime, afterEntry, err := decodeCursor(c)
+		if err != nil {
+			return filter, errors.New("invalid cursor")
+		}
+		filter.AfterTime = sql.NullTime{Time: afterTime, Valid: true}
+		filter.AfterEntry = sql.NullString{String: afterEntry, Valid: true}
+	}
+	return filter, nil
+}
+
+// listHistory reads a page of a store's history, fetching one extra entry to
+// tell whether there is a next page
+func listHistory(db *sql.DB, storeID int, storeName string, filter Filter) (History, error) {
+	history := History{StoreName: storeName, Entries: []Entry{}}
+	rows, err := db.Query(GenerateHistoryQuery(), storeID, filter.From, filter.To, filter.RedemptionType, filter.OfferID, filter.Status, filter.AfterTime, filter.AfterEntry, filter.Limit+1)
+	if err != nil {
+		return history, err
+	}
+	defer rows.Close()
+
+	var lastEntryID string
+	for rows.Next() {
+		var entry Entry
+		var entryID string
+		var code sql.NullString
+		var voidedAt sql.NullTime
+		var deviceID sql.NullString
+		var tierName sql.NullString
+		if err = rows.Scan(&entry.RedemptionType, &entry.ID, &code, &entry.Status, &entry.RedeemedAt, &voidedAt, &entry.RewardDescription, &tierName, &entry.InstagramAccount, &entry.OfferID, &deviceID, &entryID); err != nil {
+			return history, err
+		}
+		if len(history.Entries) == filter.Limit {
+			last := history.Entries[len(history.Entries)-1]
+			history.NextCursor = encodeCursor(last.RedeemedAt, lastEntryID)
+			break
+		}
+		entry.Code = code.String
+		entry.TierName = tierName.String
+		entry.DeviceID = deviceID.String
+		if voidedAt.Valid {
+			entry.VoidedAt = &voidedAt.Time
+		}
+		history.Entries = append(history.Entries, entry)
+		lastEntryID = entryID
+	}
+	return history, rows.Err()
+}
+
+// errorResponse builds an error response with a machine readable error code
+func errorResponse(statusCode int, code string, message string) Response {
+	return Response{StatusCode: statusCode,
+		Body: fmt.Sprintf(" { \"error\" : \"%s\", \"message\" : \"%s\" } ", code, message),
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin":      "*",
+			"Access-Control-Allow-Credentials": "true",
+		},
+	}
+}
+
+// Handler is our lambda handler invoked by the `lambda.Start` function call
+func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (Response, error) {
+
+	apiKey := request.QueryStringParameters["api_key"]
+
+	// Ensure all fields are not empty
+	if apiKey != "" {
+
+		log.Printf("Info: Request API key %s", apikey.Visible(apiKey))
+
+		filter, err := parseFilter(request.QueryStringParameters)
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return errorResponse(400, "INVALID_FILTER", err.Error()), nil
+		}
+
+		// Connect to database
+		connStr := fmt.Sprintf("host=%s user=%s password=%s dbname=%s sslmode=disable",
+			os.Getenv("DB_HOST"), os.Getenv("DB_USER"), os.Getenv("DB_PASSWORD"), os.Getenv("DB_NAME"))
+
+		db, err := sql.Open("postgres", connStr)
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		defer db.Close()
+
+		// Validate API key
+		storeID, storeName, err := apikey.Authenticate(db, apiKey)
+		switch err {
+		case apikey.ErrInvalid:
+			log.Printf("Error: No store with API key [%s] was found", apikey.Visible(apiKey))
+			return Response{StatusCode: 401,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		case nil:
+			log.Printf("Info: Retreived store as [%s]", storeName)
+		default:
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		history, err := listHistory(db, storeID, storeName, filter)
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+		log.Printf("Success: Listed %d history entries", len(history.Entries))
+
+		//Generate message that want to be sent as body
+		message, err := json.Marshal(history)
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		//Returning response with AWS Lambda Proxy Response
+		return Response{StatusCode: 200,
+			Body: string(message),
+			Headers: map[string]string{
+				"Access-Control-Allow-Origin":      "*",
+				"Access-Control-Allow-Credentials": "true",
+			},
+		}, nil
+	}
+
+	// Missing one of required parameters
+	log.Printf("Error: Request missing a required parameter")
+	return Response{StatusCode: 400,
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin":      "*",
+			"Access-Control-Allow-Credentials": "true",
+		},
+	}, nil
+}
+
+type LocalServer struct{}
+
+func (l *LocalServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("Error reading request body: %v", err)
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("Failed to write body: %v", err)))
+		return
+	}
+
+	url, err := url.Parse(r.URL.String())
+	if err != nil {
+		log.Printf("Error parsing query string: %v", err)
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("Malformed query string: %v", err)))
+		return
+	}
+	queryParams := url.Query()
+
+	//**building request**
+	req := events.APIGatewayProxyRequest{
+		Body:                  string(body),
+		Headers:               make(map[string]string),
+		HTTPMethod:            r.Method,
+		Path:                  r.URL.Path,
+		QueryStringParameters: make(map[string]string),
+	}
+
+	//map raw request headers
+	for k, v := range r.Header {
+		req.Headers[strings.ToLower(k)] = v[0]
+	}
+
+	//Map raw query params
+	for k, v := range queryParams {
+		req.QueryStringParameters[strings.ToLower(k)] = v[0]
+	}
+
+	resp, err := Handler(r.Context(), req)
+	if err != nil {
+		log.Printf("Error handling request: %v", err)
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("Error handling request: %v", err)))
+		return
+	}
+	for k, v := range resp.Headers {
+		w.Header().Add(k, v)
+	}
+	(w).Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(resp.StatusCode)
+	w.Write([]byte(resp.Body))
+}
+
+func local() {
+	server := &LocalServer{}
+	fmt.Println("Starting local dev server on :8080")
+	http.ListenAndServe(":8080", server)
+}
+
+func main() {
+	if os.Getenv("AWS_LAMBDA_FUNCTION_NAME") == "" {
+		//see local creds file for env vars
+		local()
+	} else {
+		// Make the handler available for Remote Procedure Call by AWS Lambda
+		lambda.Start(Handler)
+	}
+}
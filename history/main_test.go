@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	toronto := time.FixedZone("EST", -5*60*60)
+	tests := []struct {
+		redeemedAt time.Time
+		entryID    string
+	}{
+		{time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC), "C1"},
+		{time.Date(2024, 3, 1, 12, 0, 0, 123456789, time.UTC), "I42"},
+		{time.Date(2024, 3, 1, 7, 0, 0, 0, toronto), "V7"},
+		{time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC), "C1,2"},
+	}
+
+	for _, tt := range tests {
+		cursor := encodeCursor(tt.redeemedAt, tt.entryID)
+		redeemedAt, entryID, err := decodeCursor(cursor)
+		if err != nil {
+			t.Errorf("decodeCursor(encodeCursor(%v, %q)): %v", tt.redeemedAt, tt.entryID, err)
+			continue
+		}
+		if !redeemedAt.Equal(tt.redeemedAt) || entryID != tt.entryID {
+			t.Errorf("decodeCursor(encodeCursor(%v, %q)) = %v, %q", tt.redeemedAt, tt.entryID, redeemedAt, entryID)
+		}
+	}
+}
+
+func TestDecodeCursorRejects(t *testing.T) {
+	encode := func(raw string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(raw))
+	}
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{"not base64", "!!!"},
+		{"padded base64", base64.URLEncoding.EncodeToString([]byte("2024-03-01T12:00:00Z,C1"))},
+		{"no entry", encode("2024-03-01T12:00:00Z")},
+		{"empty entry", encode("2024-03-01T12:00:00Z,")},
+		{"bad time", encode("yesterday,C1")},
+		{"date only", encode("2024-03-01,C1")},
+		{"empty", encode("")},
+	}
+
+	for _, tt := range tests {
+		if _, _, err := decodeCursor(tt.cursor); err == nil {
+			t.Errorf("%s: decodeCursor(%q) succeeded, want an error", tt.name, tt.cursor)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	tests := []struct {
+		value   string
+		upper   bool
+		want    time.Time
+		valid   bool
+		wantErr bool
+	}{
+		{"", false, time.Time{}, false, false},
+		{"", true, time.Time{}, false, false},
+		{"2024-03-01", false, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), true, false},
+		// A date as the upper bound takes in the whole day
+		{"2024-03-01", true, time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC), true, false},
+		{"2024-12-31", true, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), true, false},
+		{"2024-02-29", true, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), true, false},
+		// An exact time is taken as is, either way
+		{"2024-03-01T15:04:05Z", false, time.Date(2024, 3, 1, 15, 4, 5, 0, time.UTC), true, false},
+		{"2024-03-01T15:04:05Z", true, time.Date(2024, 3, 1, 15, 4, 5, 0, time.UTC), true, false},
+		{"2024-03-01T10:04:05-05:00", true, time.Date(2024, 3, 1, 15, 4, 5, 0, time.UTC), true, false},
+		{"2024-02-30", false, time.Time{}, false, true},
+		{"03/01/2024", false, time.Time{}, false, true},
+		{"2024-03-01 15:04:05", false, time.Time{}, false, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseTime(tt.value, tt.upper)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTime(%q, %v) error = %v, want error %v", tt.value, tt.upper, err, tt.wantErr)
+			continue
+		}
+		if got.Valid != tt.valid || !got.Time.Equal(tt.want) {
+			t.Errorf("parseTime(%q, %v) = %v (valid %v), want %v (valid %v)", tt.value, tt.upper, got.Time, got.Valid, tt.want, tt.valid)
+		}
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	cursor := encodeCursor(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC), "C9")
+	tests := []struct {
+		name    string
+		params  map[string]string
+		wantErr string
+		check   func(Filter) bool
+	}{
+		{"defaults", map[string]string{}, "", func(f Filter) bool {
+			return f.Limit == defaultLimit && !f.From.Valid && !f.To.Valid && !f.RedemptionType.Valid && !f.OfferID.Valid && !f.Status.Valid && !f.AfterTime.Valid
+		}},
+		{"date range", map[string]string{"from": "2024-03-01", "to": "2024-03-31"}, "", func(f Filter) bool {
+			return f.From.Time.Equal(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)) && f.To.Time.Equal(time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC))
+		}},
+		{"every filter", map[string]string{"redemption_type": "INSTANT", "offer_id": "12", "status": "VOIDED", "limit": "10"}, "", func(f Filter) bool {
+			return f.RedemptionType.String == "INSTANT" && f.OfferID.Int64 == 12 && f.Status.String == "VOIDED" && f.Limit == 10
+		}},
+		{"largest page", map[string]string{"limit": "200"}, "", func(f Filter) bool {
+			return f.Limit == maxLimit
+		}},
+		{"cursor", map[string]string{"cursor": cursor}, "", func(f Filter) bool {
+			return f.AfterTime.Valid && f.AfterTime.Time.Equal(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)) && f.AfterEntry.String == "C9"
+		}},
+		{"bad from", map[string]string{"from": "yesterday"}, "invalid from", nil},
+		{"bad to", map[string]string{"to": "2024-13-01"}, "invalid to", nil},
+		{"bad redemption type", map[string]string{"redemption_type": "coupon"}, "invalid redemption type", nil},
+		{"bad offer id", map[string]string{"offer_id": "1.5"}, "invalid offer id", nil},
+		{"offer id out of range", map[string]string{"offer_id": "2147483648"}, "invalid offer id", nil},
+		{"bad status", map[string]string{"status": "PENDING"}, "invalid status", nil},
+		{"zero limit", map[string]string{"limit": "0"}, "invalid limit", nil},
+		{"limit too large", map[string]string{"limit": "201"}, "invalid limit", nil},
+		{"bad limit", map[string]string{"limit": "ten"}, "invalid limit", nil},
+		{"bad cursor", map[string]string{"cursor": "not a cursor"}, "invalid cursor", nil},
+		{"malformed cursor", map[string]string{"cursor": base64.RawURLEncoding.EncodeToString([]byte("2024-03-01T12:00:00Z"))}, "invalid cursor", nil},
+	}
+
+	for _, tt := range tests {
+		filter, err := parseFilter(tt.params)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("%s: parseFilter error = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: parseFilter: %v", tt.name, err)
+			continue
+		}
+		if !tt.check(filter) {
+			t.Errorf("%s: parseFilter = %+v", tt.name, filter)
+		}
+	}
+}
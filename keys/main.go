@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/addauda/bubble-rewards-storefront-api/apikey"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	_ "github.com/lib/pq"
+)
+
+// Response is of type APIGatewayProxyResponse since we're leveraging the
+// AWS Lambda Proxy Request functionality (default behavior)
+//
+// https://serverless.com/framework/docs/providers/aws/events/apigateway/#lambda-proxy-integration
+type Response events.APIGatewayProxyResponse
+
+const expiration = time.Hour
+
+var client = &http.Client{}
+
+// Keys lists a store's keys, without the keys themselves
+type Keys struct {
+	Keys []apikey.Key `json:"keys"`
+}
+
+// GenerateKeysQuery lists a store's keys, newest first
+func GenerateKeysQuery() string {
+	return "SELECT id, prefix, label, created_at, last_used_at, expire_at, revoked_at from api_keys WHERE store_id = $1 ORDER BY created_at DESC, id DESC"
+}
+
+// listKeys reads every key of a store, including revoked and expired ones
+func listKeys(db *sql.DB, storeID int) (Keys, error) {
+	list := Keys{Keys: []apikey.Key{}}
+	rows, err := db.Query(GenerateKeysQuery(), storeID)
+	if err != nil {
+		return list, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key apikey.Key
+		if err = rows.Scan(&key.ID, &key.Prefix, &key.Label, &key.CreatedAt, &key.LastUsedAt, &key.ExpireAt, &key.RevokedAt); err != nil {
+			return list, err
+		}
+		list.Keys = append(list.Keys, key)
+	}
+	return list, rows.Err()
+}
+
+// Handler is our lambda handler invoked by the `lambda.Start` function call.
+// GET lists the store's keys, so that a store rotating a key can see when the
+// old one stopped being used. Keys are only issued and revoked by an admin
+func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (Response, error) {
+
+	apiKey := request.QueryStringParameters["api_key"]
+
+	// Ensure all fields are not empty
+	if apiKey != "" && request.HTTPMethod == "GET" {
+
+		log.Printf("Info: Request API key %s", apikey.Visible(apiKey))
+
+		// Connect to database
+		connStr := fmt.Sprintf("host=%s user=%s password=%s dbname=%s sslmode=disable",
+			os.Getenv("DB_HOST"), os.Getenv("DB_USER"), os.Getenv("DB_PASSWORD"), os.Getenv("DB_NAME"))
+
+		db, err := sql.Open("postgres", connStr)
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		defer db.Close()
+
+		// Validate API key
+		storeID, storeName, err := apikey.Authenticate(db, apiKey)
+		switch err {
+		case apikey.ErrInvalid:
+			log.Printf("Error: No store with API key [%s] was found", apikey.Visible(apiKey))
+			return Response{StatusCode: 401,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		case nil:
+			log.Printf("Info: Retreived store as [%s]", storeName)
+		default:
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		keys, err := listKeys(db, storeID)
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		//Generate message that want to be sent as body
+		message, err := json.Marshal(keys)
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		//Returning response with AWS Lambda Proxy Response
+		return Response{StatusCode: 200,
+			Body: string(message),
+			Headers: map[string]string{
+				"Access-Control-Allow-Origin":      "*",
+				"Access-Control-Allow-Credentials": "true",
+			},
+		}, nil
+	}
+
+	// Missing one of required parameters
+	log.Printf("Error: Request missing a required parameter")
+	return Response{StatusCode: 400,
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin":      "*",
+			"Access-Control-Allow-Credentials": "true",
+		},
+	}, nil
+}
+
+type LocalServer struct{}
+
+func (l *LocalServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("Error reading request body: %v", err)
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("Failed to write body: %v", err)))
+		return
+	}
+
+	url, err := url.Parse(r.URL.String())
+	if err != nil {
+		log.Printf("Error parsing query string: %v", err)
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("Malformed query string: %v", err)))
+		return
+	}
+	queryParams := url.Query()
+
+	//**building request**
+	req := events.APIGatewayProxyRequest{
+		Body:                  string(body),
+		Headers:               make(map[string]string),
+		HTTPMethod:            r.Method,
+		Path:                  r.URL.Path,
+		QueryStringParameters: make(map[string]string),
+	}
+
+	//map raw request headers
+	for k, v := range r.Header {
+		req.Headers[strings.ToLower(k)] = v[0]
+	}
+
+	//Map raw query params
+	for k, v := range queryParams {
+		req.QueryStringParameters[strings.ToLower(k)] = v[0]
+	}
+
+	resp, err := Handler(r.Context(), req)
+	if err != nil {
+		log.Printf("Error handling request: %v", err)
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("Error handling request: %v", err)))
+		return
+	}
+	for k, v := range resp.Headers {
+		w.Header().Add(k, v)
+	}
+	(w).Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(resp.StatusCode)
+	w.Write([]byte(resp.Body))
+}
+
+func local() {
+	server := &LocalServer{}
+	fmt.Println("Starting local dev server on :8080")
+	http.ListenAndServe(":8080", server)
+}
+
+func main() {
+	if os.Getenv("AWS_LAMBDA_FUNCTION_NAME") == "" {
+		//see local creds file for env vars
+		local()
+	} else {
+		// Make the handler available for Remote Procedure Call by AWS Lambda
+		lambda.Start(Handler)
+	}
+}
@@ -0,0 +1,13 @@
+/* Allow a single instant redemption per submission on existing databases.
+   Repeated redemptions are collapsed onto the earliest one. */
+BEGIN;
+
+DELETE FROM public.redemptions_instant duplicate
+USING public.redemptions_instant original
+WHERE duplicate.submission_id = original.submission_id
+AND (COALESCE(duplicate.redeemed_at, '-infinity'), duplicate.id) > (COALESCE(original.redeemed_at, '-infinity'), original.id);
+
+ALTER TABLE public.redemptions_instant
+ADD CONSTRAINT redemptions_instant_submission_id_key UNIQUE (submission_id);
+
+COMMIT;
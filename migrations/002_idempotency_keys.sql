@@ -0,0 +1,15 @@
+/* Store responses to POST /redeem by idempotency key */
+BEGIN;
+
+CREATE TABLE public.idempotency_keys (
+	id SERIAL PRIMARY KEY,
+	idempotency_key VARCHAR(255) NOT NULL,
+	store_id INTEGER REFERENCES stores(id) NOT NULL,
+	request text NOT NULL,
+	status_code INTEGER,
+	response_body text,
+	created_at timestamptz NOT NULL DEFAULT now(),
+	UNIQUE (store_id, idempotency_key)
+);
+
+COMMIT;
@@ -0,0 +1,19 @@
+/* Record voided redemptions */
+BEGIN;
+
+CREATE TYPE void_reason AS ENUM ('WRONG_REDEMPTION', 'WRONG_CUSTOMER', 'DUPLICATE', 'CUSTOMER_REQUEST', 'OTHER');
+
+CREATE TABLE public.redemption_voids (
+	id SERIAL PRIMARY KEY,
+	redemption_type VARCHAR(7) NOT NULL,
+	coupon_id INTEGER REFERENCES redemptions_coupon(id),
+	submission_id INTEGER REFERENCES submissions(id) NOT NULL,
+	redeemed_at timestamptz,
+	reason void_reason NOT NULL,
+	note text,
+	voided_by text NOT NULL,
+	store_id INTEGER REFERENCES stores(id) NOT NULL,
+	voided_at timestamptz NOT NULL DEFAULT now()
+);
+
+COMMIT;
@@ -0,0 +1,20 @@
+/* Allow coupons to be redeemed more than once */
+BEGIN;
+
+ALTER TABLE public.redemptions_coupon
+ADD COLUMN max_uses INTEGER NOT NULL DEFAULT 1 CHECK (max_uses > 0),
+ADD COLUMN use_count INTEGER NOT NULL DEFAULT 0 CHECK (use_count >= 0 AND use_count <= max_uses);
+
+CREATE TABLE public.redemptions_coupon_uses (
+	id SERIAL PRIMARY KEY,
+	coupon_id INTEGER REFERENCES redemptions_coupon(id) NOT NULL,
+	redeemed_at timestamptz NOT NULL DEFAULT now()
+);
+
+/* Coupons redeemed so far were single use */
+UPDATE public.redemptions_coupon SET use_count = 1 WHERE status = 'REDEEMED';
+
+INSERT INTO public.redemptions_coupon_uses (coupon_id, redeemed_at)
+SELECT id, COALESCE(redeemed_at, created_at) FROM public.redemptions_coupon WHERE status = 'REDEEMED';
+
+COMMIT;
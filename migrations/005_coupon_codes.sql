@@ -0,0 +1,38 @@
+/* Coupon codes are now generated by the coupon package and must be unique
+   among active coupons. Existing codes stay valid, pending coupons sharing a
+   code are given fresh ones in the same legacy format, which is looked up
+   without a check character. */
+BEGIN;
+
+ALTER TABLE public.redemptions_coupon
+ALTER COLUMN code TYPE VARCHAR(16),
+ALTER COLUMN code DROP DEFAULT;
+
+DO $$
+DECLARE
+	duplicate RECORD;
+	fresh VARCHAR(4);
+BEGIN
+	FOR duplicate IN
+		SELECT id FROM (
+			SELECT id, row_number() OVER (PARTITION BY code ORDER BY id) AS n
+			FROM public.redemptions_coupon WHERE "status" = 'PENDING'
+		) ranked WHERE n > 1
+	LOOP
+		/* The legacy code space is small, keep drawing until a code is free */
+		LOOP
+			fresh := UPPER(LEFT(MD5(random()::text), 4));
+			EXIT WHEN NOT EXISTS (
+				SELECT 1 FROM public.redemptions_coupon WHERE "status" = 'PENDING' AND code = fresh
+			);
+		END LOOP;
+
+		UPDATE public.redemptions_coupon
+		SET code = fresh
+		WHERE id = duplicate.id;
+	END LOOP;
+END $$;
+
+CREATE UNIQUE INDEX redemptions_coupon_active_code ON public.redemptions_coupon (code) WHERE "status" = 'PENDING';
+
+COMMIT;
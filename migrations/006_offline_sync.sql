@@ -0,0 +1,21 @@
+/* Sync redemptions made while a POS was offline */
+BEGIN;
+
+ALTER TABLE public.redemptions_instant ADD COLUMN device_id text;
+ALTER TABLE public.redemptions_coupon_uses ADD COLUMN device_id text;
+
+CREATE TABLE public.offline_redemptions (
+	id SERIAL PRIMARY KEY,
+	store_id INTEGER REFERENCES stores(id) NOT NULL,
+	device_id text NOT NULL,
+	local_id text NOT NULL,
+	redemption_type VARCHAR(7) NOT NULL,
+	redemption_id text NOT NULL,
+	redeemed_at timestamptz NOT NULL,
+	"status" VARCHAR(16),
+	result text,
+	synced_at timestamptz NOT NULL DEFAULT now(),
+	UNIQUE (store_id, device_id, local_id)
+);
+
+COMMIT;
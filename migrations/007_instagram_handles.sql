@@ -0,0 +1,31 @@
+/* Store Instagram handles in one canonical form */
+BEGIN;
+
+CREATE FUNCTION normalize_instagram_handle(handle text) RETURNS text AS $$
+	SELECT '@' || lower(regexp_replace(btrim(handle, E' \t\n\r\x0B\f'), '^@', ''))
+$$ LANGUAGE sql IMMUTABLE STRICT;
+
+CREATE FUNCTION normalize_submission_handle() RETURNS trigger AS $$
+BEGIN
+	NEW.instagram_account := normalize_instagram_handle(NEW.instagram_account);
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER submissions_normalize_handle
+BEFORE INSERT OR UPDATE OF instagram_account ON public.submissions
+FOR EACH ROW EXECUTE PROCEDURE normalize_submission_handle();
+
+/* Backfill existing submissions */
+UPDATE public.submissions SET instagram_account = normalize_instagram_handle(instagram_account)
+WHERE instagram_account <> normalize_instagram_handle(instagram_account);
+
+/* Handles that still break Instagram's rules after normalizing have to be
+   fixed by hand, find them with
+   SELECT id, instagram_account FROM submissions WHERE NOT (instagram_account ~ '^@[a-z0-9_]+(\.[a-z0-9_]+)*$' AND char_length(instagram_account) <= 31);
+   then run ALTER TABLE public.submissions VALIDATE CONSTRAINT submissions_instagram_account_check; */
+ALTER TABLE public.submissions
+ADD CONSTRAINT submissions_instagram_account_check
+CHECK (instagram_account ~ '^@[a-z0-9_]+(\.[a-z0-9_]+)*$' AND char_length(instagram_account) <= 31) NOT VALID;
+
+COMMIT;
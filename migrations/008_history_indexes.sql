@@ -0,0 +1,8 @@
+/* Index redemptions by time for the history endpoint */
+BEGIN;
+
+CREATE INDEX redemptions_coupon_uses_redeemed_at ON public.redemptions_coupon_uses (redeemed_at);
+CREATE INDEX redemptions_instant_redeemed_at ON public.redemptions_instant (redeemed_at);
+CREATE INDEX redemption_voids_store_redeemed_at ON public.redemption_voids (store_id, redeemed_at);
+
+COMMIT;
@@ -0,0 +1,21 @@
+/* Record what the expiry sweeper changes */
+BEGIN;
+
+CREATE TABLE public.expiry_sweeps (
+	id SERIAL PRIMARY KEY,
+	started_at timestamptz NOT NULL DEFAULT now(),
+	finished_at timestamptz,
+	coupons_expired INTEGER,
+	submissions_expired INTEGER
+);
+
+CREATE TABLE public.expired_redemptions (
+	id SERIAL PRIMARY KEY,
+	sweep_id INTEGER REFERENCES expiry_sweeps(id) NOT NULL,
+	redemption_type VARCHAR(7) NOT NULL,
+	redemption_id INTEGER NOT NULL,
+	expire_at timestamptz NOT NULL,
+	expired_at timestamptz NOT NULL DEFAULT now()
+);
+
+COMMIT;
@@ -0,0 +1,9 @@
+/* Record who moderated a submission, when and why */
+BEGIN;
+
+ALTER TABLE public.submissions
+ADD COLUMN decision_reason text,
+ADD COLUMN decided_by text,
+ADD COLUMN decided_at timestamptz;
+
+COMMIT;
@@ -0,0 +1,7 @@
+/* Let each offer set how long the coupons it issues stay valid */
+BEGIN;
+
+ALTER TABLE public.offers
+ADD COLUMN coupon_validity interval NOT NULL DEFAULT interval '3 months' CHECK (coupon_validity > interval '0');
+
+COMMIT;
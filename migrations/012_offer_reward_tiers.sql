@@ -0,0 +1,32 @@
+/* Let offers reward bigger accounts with bigger rewards */
+BEGIN;
+
+CREATE TABLE public.offer_reward_tiers (
+	id SERIAL PRIMARY KEY,
+	offer_id INTEGER REFERENCES offers(id) NOT NULL,
+	"name" text NOT NULL,
+	min_followers INTEGER NOT NULL CHECK (min_followers >= 0),
+	instant_reward_id INTEGER REFERENCES rewards(id),
+	loyalty_reward_id INTEGER REFERENCES rewards(id),
+	created_at timestamptz NOT NULL DEFAULT now(),
+	updated_at timestamptz NOT NULL DEFAULT now(),
+	UNIQUE (offer_id, min_followers)
+);
+
+/* The rewards a submission earns, from the highest tier of its offer its
+   follower count reaches, falling back to the offer's own rewards */
+CREATE VIEW public.submission_rewards AS
+SELECT submissions.id AS submission_id, tier.name AS tier_name,
+	COALESCE(tier.instant_reward_id, offers.instant_reward_id) AS instant_reward_id,
+	COALESCE(tier.loyalty_reward_id, offers.loyalty_reward_id) AS loyalty_reward_id
+FROM public.submissions
+JOIN public.offers ON submissions.offer_id = offers.id
+LEFT JOIN LATERAL (
+	SELECT offer_reward_tiers.name, offer_reward_tiers.instant_reward_id, offer_reward_tiers.loyalty_reward_id
+	FROM public.offer_reward_tiers
+	WHERE offer_reward_tiers.offer_id = offers.id AND offer_reward_tiers.min_followers <= submissions.follower_count
+	ORDER BY offer_reward_tiers.min_followers DESC
+	LIMIT 1
+) tier ON true;
+
+COMMIT;
@@ -0,0 +1,7 @@
+/* Search rewards and actions by description and keywords */
+BEGIN;
+
+CREATE INDEX actions_search ON public.actions USING GIN (to_tsvector('english', description || ' ' || COALESCE(keywords, '')));
+CREATE INDEX rewards_search ON public.rewards USING GIN (to_tsvector('english', description || ' ' || COALESCE(keywords, '')));
+
+COMMIT;
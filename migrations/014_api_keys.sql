@@ -0,0 +1,24 @@
+/* Move store API keys into their own table, stored hashed */
+BEGIN;
+
+CREATE TABLE public.api_keys (
+	id SERIAL PRIMARY KEY,
+	store_id INTEGER REFERENCES stores(id) NOT NULL,
+	prefix VARCHAR(12) NOT NULL,
+	key_hash CHAR(64) UNIQUE NOT NULL,
+	label text NOT NULL,
+	created_at timestamptz NOT NULL DEFAULT now(),
+	last_used_at timestamptz,
+	expire_at timestamptz,
+	revoked_at timestamptz
+);
+
+CREATE INDEX api_keys_store ON public.api_keys (store_id);
+
+/* Existing keys keep working, and are identified by their first 12 characters */
+INSERT INTO public.api_keys (store_id, prefix, key_hash, label)
+SELECT id, left(api_key::text, 12), encode(sha256(api_key::text::bytea), 'hex'), 'Legacy key' FROM public.stores;
+
+ALTER TABLE public.stores DROP COLUMN api_key;
+
+COMMIT;
@@ -0,0 +1,7 @@
+/* Record the API key each void was made with, as voided_by is only what the
+   client says. Earlier voids are left without one. */
+BEGIN;
+
+ALTER TABLE public.redemption_voids ADD COLUMN api_key_id INTEGER REFERENCES api_keys(id);
+
+COMMIT;
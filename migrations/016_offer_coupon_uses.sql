@@ -0,0 +1,7 @@
+/* Let each offer set how many times the coupons it issues can be redeemed */
+BEGIN;
+
+ALTER TABLE public.offers
+ADD COLUMN coupon_uses INTEGER NOT NULL DEFAULT 1 CHECK (coupon_uses > 0);
+
+COMMIT;
@@ -0,0 +1,8 @@
+/* Let each offer set how long instant rewards stay redeemable once their
+   submission is accepted */
+BEGIN;
+
+ALTER TABLE public.offers
+ADD COLUMN instant_reward_validity interval NOT NULL DEFAULT interval '2 days' CHECK (instant_reward_validity > interval '0');
+
+COMMIT;
@@ -0,0 +1,7 @@
+/* Record the API key each moderation decision was made with, as decided_by
+   is only what the client says. Earlier decisions are left without one. */
+BEGIN;
+
+ALTER TABLE public.submissions ADD COLUMN api_key_id INTEGER REFERENCES api_keys(id);
+
+COMMIT;
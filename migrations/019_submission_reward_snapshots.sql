@@ -0,0 +1,20 @@
+/* Save the tier and rewards a submission earns on the submission when it is
+   accepted, so that later changes to the offer or its tiers leave coupons
+   already issued, instant rewards and history alone. Existing submissions
+   keep what they resolve to now; pending ones are resolved again when
+   accepted. */
+BEGIN;
+
+ALTER TABLE public.submissions
+ADD COLUMN tier_name text,
+ADD COLUMN instant_reward_id INTEGER REFERENCES rewards(id),
+ADD COLUMN loyalty_reward_id INTEGER REFERENCES rewards(id);
+
+UPDATE public.submissions
+SET tier_name = submission_rewards.tier_name,
+	instant_reward_id = submission_rewards.instant_reward_id,
+	loyalty_reward_id = submission_rewards.loyalty_reward_id
+FROM public.submission_rewards
+WHERE submission_rewards.submission_id = submissions.id;
+
+COMMIT;
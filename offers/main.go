@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/addauda/bubble-rewards-storefront-api/apikey"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	_ "github.com/lib/pq"
+)
+
+// Response is of type APIGatewayProxyResponse since we're leveraging the
+// AWS Lambda Proxy Request functionality (default behavior)
+//
+// https://serverless.com/framework/docs/providers/aws/events/apigateway/#lambda-proxy-integration
+type Response events.APIGatewayProxyResponse
+
+const expiration = time.Hour
+
+var client = &http.Client{}
+
+// Queryer is satisfied by both *sql.DB and *sql.Tx
+type Queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// OfferRequest is the body of a create or update. Fields left out of an
+// update keep their current value
+type OfferRequest struct {
+	ID                        json.Number `json:"id"`
+	ActionID                  *int        `json:"action_id"`
+	InstantRewardID           *int        `json:"instant_reward_id"`
+	LoyaltyRewardID           *int        `json:"loyalty_reward_id"`
+	CouponValidityDays        *int        `json:"coupon_validity_days"`
+	CouponUses                *int        `json:"coupon_uses"`
+	InstantRewardValidityDays *int        `json:"instant_reward_validity_days"`
+	Status                    *string     `json:"status"`
+}
+
+// Offer is an offer as returned to its store
+type Offer struct {
+	ID                       string    `json:"id"`
+	Status                   string    `json:"status"`
+	ActionID                 string    `json:"actionId"`
+	ActionDescription        string    `json:"actionDescription"`
+	InstantRewardID          string    `json:"instantRewardId"`
+	InstantRewardDescription string    `json:"instantRewardDescription"`
+	LoyaltyRewardID          string    `json:"loyaltyRewardId"`
+	LoyaltyRewardDescription string    `json:"loyaltyRewardDescription"`
+	CouponValidity           string    `json:"couponValidity"`
+	CouponUses               int       `json:"couponUses"`
+	InstantRewardValidity    string    `json:"instantRewardValidity"`
+	CreatedAt                time.Time `json:"createdAt"`
+	UpdatedAt                time.Time `json:"updatedAt"`
+}
+
+// Offers lists a store's offers
+type Offers struct {
+	Offers []Offer `json:"offers"`
+}
+
+// Refusal explains why a change was refused
+type Refusal struct {
+	StatusCode int    `json:"-"`
+	Code       string `json:"error"`
+	Message    string `json:"message"`
+}
+
+// GenerateOffersQuery lists a store's offers, or the one with id $2, with the
+// descriptions of their action and rewards
+func GenerateOffersQuery() string {
+	return "SELECT offers.id, offers.status, actions.id, actions.description, instant.id, instant.description, loyalty.id, loyalty.description, offers.coupon_validity::text, offers.coupon_uses, offers.instant_reward_validity::text, offers.created_at, offers.updated_at from offers join actions on offers.action_id = actions.id join rewards instant on offers.instant_reward_id = instant.id join rewards loyalty on offers.loyalty_reward_id = loyalty.id WHERE offers.store_id = $1 AND ($2::integer IS NULL OR offers.id = $2) AND ($3::text IS NULL OR offers.status::text = $3) ORDER BY offers.id"
+}
+
+// GenerateReferencesQuery checks that the action and rewards an offer refers
+// to exist, null ids being left unchecked
+func GenerateReferencesQuery() string {
+	return "SELECT ($1::integer IS NULL OR EXISTS (SELECT 1 from actions WHERE id = $1)), ($2::integer IS NULL OR EXISTS (SELECT 1 from rewards WHERE id = $2)), ($3::integer IS NULL OR EXISTS (SELECT 1 from rewards WHERE id = $3))"
+}
+
+// GenerateCreateOfferQuery creates an offer. The fallbacks match the column
+// defaults
+func GenerateCreateOfferQuery() string {
+	return "INSERT INTO offers (action_id, instant_reward_id, loyalty_reward_id, store_id, coupon_validity, status, coupon_uses, instant_reward_validity) VALUES ($1, $2, $3, $4, COALESCE(make_interval(days => $5::integer), interval '3 months'), COALESCE($6::status, 'ACTIVE'), COALESCE($7::integer, 1), COALESCE(make_interval(days => $8::integer), interval '2 days')) RETURNING id"
+}
+
+// GenerateLockOfferQuery reads the store owning an offer, locking the row
+func GenerateLockOfferQuery() string {
+	return "SELECT store_id from offers WHERE id = $1 FOR UPDATE"
+}
+
+// GenerateUpdateOfferQuery changes the fields of an offer that are not null
+func GenerateUpdateOfferQuery() string {
+	return "UPDATE offers SET action_id = COALESCE($2, action_id), instant_reward_id = COALESCE($3, instant_reward_id), loyalty_reward_id = COALESCE($4, loyalty_reward_id), coupon_validity = COALESCE(make_interval(days => $5::integer), coupon_validity), status = COALESCE($6::status, status), coupon_uses = COALESCE($7::integer, coupon_uses), instant_reward_validity = COALESCE(make_interval(days => $8::integer), instant_reward_validity), updated_at = now() WHERE id = $1"
+}
+
+// parseOffer reads a create or update. A create has to name an action and
+// both rewards, which an update may leave unchanged
+func parseOffer(method string, body string) (OfferRequest, *Refusal) {
+	var offer OfferRequest
+	if err := json.Unmarshal([]byte(body), &offer); err != nil {
+		log.Printf("Error: Malformed request body: %v", err)
+		return offer, &Refusal{StatusCode: 400, Code: "INVALID_REQUEST", Message: "Malformed request body"}
+	}
+
+	if method == "POST" && (offer.ActionID == nil || offer.InstantRewardID == nil || offer.LoyaltyRewardID == nil) {
+		return offer, &Refusal{StatusCode: 400, Code: "INVALID_REQUEST", Message: "action_id, instant_reward_id and loyalty_reward_id are required"}
+	}
+	if _, err := offer.ID.Int64(); method == "PUT" && err != nil {
+		return offer, &Refusal{StatusCode: 400, Code: "INVALID_REQUEST", Message: "An offer id is required"}
+	}
+	if offer.CouponValidityDays != nil && *offer.CouponValidityDays < 1 {
+		return offer, &Refusal{StatusCode: 400, Code: "INVALID_REQUEST", Message: "coupon_validity_days must be at least 1"}
+	}
+	if offer.CouponUses != nil && *offer.CouponUses < 1 {
+		return offer, &Refusal{StatusCode: 400, Code: "INVALID_REQUEST", Message: "coupon_uses must be at least 1"}
+	}
+	if offer.InstantRewardValidityDays != nil && *offer.InstantRewardValidityDays < 1 {
+		return offer, &Refusal{StatusCode: 400, Code: "INVALID_REQUEST", Message: "instant_reward_validity_days must be at least 1"}
+	}
+	if offer.Status != nil && *offer.Status != "ACTIVE" && *offer.Status != "INACTIVE" {
+		return offer, &Refusal{StatusCode: 400, Code: "INVALID_STATUS", Message: "Status must be ACTIVE or INACTIVE"}
+	}
+	return offer, nil
+}
+
+// checkReferences refuses an offer referring to an action or reward that
+// does not exist
+func checkReferences(tx *sql.Tx, offer OfferRequest) (*Refusal, error) {
+	var actionExists, instantExists, loyaltyExists bool
+	row := tx.QueryRow(GenerateReferencesQuery(), offer.ActionID, offer.InstantRewardID, offer.LoyaltyRewardID)
+	if err := row.Scan(&actionExists, &instantExists, &loyaltyExists); err != nil {
+		return nil, err
+	}
+	switch {
+	case !actionExists:
+		return &Refusal{StatusCode: 422, Code: "UNKNOWN_ACTION", Message: fmt.Sprintf("Action [%d] does not exist", *offer.ActionID)}, nil
+	case !instantExists:
+		return &Refusal{StatusCode: 422, Code: "UNKNOWN_REWARD", Message: fmt.Sprintf("Reward [%d] does not exist", *offer.InstantRewardID)}, nil
+	case !loyaltyExists:
+		return &Refusal{StatusCode: 422, Code: "UNKNOWN_REWARD", Message: fmt.Sprintf("Reward [%d] does not exist", *offer.LoyaltyRewardID)}, nil
+	}
+	return nil, nil
+}
+
+// listOffers reads a store's offers, or a single one when id is set
+func listOffers(q Queryer, storeID int, id sql.NullString, status sql.NullString) (Offers, error) {
+	list := Offers{Offers: []Offer{}}
+	rows, err := q.Query(GenerateOffersQuery(), storeID, id, status)
+	if err != nil {
+		return list, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var offer Offer
+		if err = rows.Scan(&offer.ID, &offer.Status, &offer.ActionID, &offer.ActionDescription, &offer.InstantRewardID, &offer.InstantRewardDescription, &offer.LoyaltyRewardID, &offer.LoyaltyRewardDescription, &offer.CouponValidity, &offer.CouponUses, &offer.InstantRewardValidity, &offer.CreatedAt, &offer.UpdatedAt); err != nil {
+			return list, err
+		}
+		list.Offers = append(list.Offers, offer)
+	}
+	return list, rows.Err()
+}
+
+// saveOffer creates or updates an offer of the calling store within tx and
+// reads it back
+func saveOffer(tx *sql.Tx, method string, storeID int, offer OfferRequest) (Offer, *Refusal, error) {
+	id := offer.ID.String()
+	if method == "PUT" {
+		var ownerID int
+		switch err := tx.QueryRow(GenerateLockOfferQuery(), id).Scan(&ownerID); err {
+		case sql.ErrNoRows:
+			return Offer{}, &Refusal{StatusCode: 404, Code: "NOT_FOUND", Message: "Offer not found"}, nil
+		case nil:
+		default:
+			return Offer{}, nil, err
+		}
+		if ownerID != storeID {
+			return Offer{}, &Refusal{StatusCode: 403, Code: "WRONG_STORE", Message: "Offer belongs to another store"}, nil
+		}
+	}
+
+	refusal, err := checkReferences(tx, offer)
+	if err != nil || refusal != nil {
+		return Offer{}, refusal, err
+	}
+
+	if method == "POST" {
+		err = tx.QueryRow(GenerateCreateOfferQuery(), offer.ActionID, offer.InstantRewardID, offer.LoyaltyRewardID, storeID, offer.CouponValidityDays, offer.Status, offer.CouponUses, offer.InstantRewardValidityDays).Scan(&id)
+	} else {
+		_, err = tx.Exec(GenerateUpdateOfferQuery(), id, offer.ActionID, offer.InstantRewardID, offer.LoyaltyRewardID, offer.CouponValidityDays, offer.Status, offer.CouponUses, offer.InstantRewardValidityDays)
+	}
+	if err != nil {
+		return Offer{}, nil, err
+	}
+
+	list, err := listOffers(tx, storeID, sql.NullString{String: id, Valid: true}, sql.NullString{})
+	if err != nil {
+		return Offer{}, nil, err
+	}
+	if len(list.Offers) != 1 {
+		return Offer{}, nil, fmt.Errorf("offer [%s] not found after saving", id)
+	}
+	log.Printf("Success: Saved offer [%s] as %s", id, list.Offers[0].Status)
+	return list.Offers[0], nil, nil
+}
+
+// refusalResponse builds an error response with a machine readable error code
+func refusalResponse(refusal *Refusal) (Response, error) {
+	body, err := json.Marshal(refusal)
+	if err != nil {
+		return Response{}, err
+	}
+	return Response{StatusCode: refusal.StatusCode,
+		Body: string(body),
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin":      "*",
+			"Access-Control-Allow-Credentials": "true",
+		},
+	}, nil
+}
+
+// Handler is our lambda handler invoked by the `lambda.Start` function call.
+// GET lists the store's offers, POST creates one and PUT updates one
+func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (Response, error) {
+
+	if strings.HasSuffix(request.Path, "/tiers") {
+		return TiersHandler(ctx, request)
+	}
+
+	apiKey := request.QueryStringParameters["api_key"]
+	method := request.HTTPMethod
+
+	// Ensure all fields are not empty
+	if apiKey != "" && (method == "GET" || method == "POST" || method == "PUT") {
+
+		log.Printf("Info: Request method %s", method)
+		log.Printf("Info: Request API key %s", apikey.Visible(apiKey))
+
+		// An unknown status would fail the cast to the status enum as a 500
+		var offer OfferRequest
+		var status sql.NullString
+		if method == "GET" {
+			if s := request.QueryStringParameters["status"]; s != "" {
+				if s != "ACTIVE" && s != "INACTIVE" {
+					return refusalResponse(&Refusal{StatusCode: 400, Code: "INVALID_STATUS", Message: "Status must be ACTIVE or INACTIVE"})
+				}
+				status = sql.NullString{String: s, Valid: true}
+			}
+		} else {
+			var refusal *Refusal
+			if offer, refusal = parseOffer(method, request.Body); refusal != nil {
+				return refusalResponse(refusal)
+			}
+		}
+
+		// Connect to database
+		connStr := fmt.Sprintf("host=%s user=%s password=%s dbname=%s sslmode=disable",
+			os.Getenv("DB_HOST"), os.Getenv("DB_USER"), os.Getenv("DB_PASSWORD"), os.Getenv("DB_NAME"))
+
+		db, err := sql.Open("postgres", connStr)
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		defer db.Close()
+
+		// Validate API key
+		storeID, storeName, err := apikey.Authenticate(db, apiKey)
+		switch err {
+		case apikey.ErrInvalid:
+			log.Printf("Error: No store with API key [%s] was found", apikey.Visible(apiKey))
+			return Response{StatusCode: 401,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		case nil:
+			log.Printf("Info: Retreived store as [%s]", storeName)
+		default:
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		var result interface{}
+		if method == "GET" {
+			result, err = listOffers(db, storeID, sql.NullString{}, status)
+		} else {
+			// Check and save within one transaction so the offer and what
+			// it refers to cannot change underneath us
+			var tx *sql.Tx
+			if tx, err = db.BeginTx(ctx, nil); err == nil {
+				var refusal *Refusal
+				result, refusal, err = saveOffer(tx, method, storeID, offer)
+				if err == nil && refusal == nil {
+					err = tx.Commit()
+				} else {
+					tx.Rollback()
+				}
+				if err == nil && refusal != nil {
+					log.Printf("Error: Saving offer refused as [%s]", refusal.Code)
+					return refusalResponse(refusal)
+				}
+			}
+		}
+
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		//Generate message that want to be sent as body
+		message, err := json.Marshal(result)
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		//Returning response with AWS Lambda Proxy Response
+		return Response{StatusCode: 200,
+			Body: string(message),
+			Headers: map[string]string{
+				"Access-Control-Allow-Origin":      "*",
+				"Access-Control-Allow-Credentials": "true",
+			},
+		}, nil
+	}
+
+	// Missing one of required parameters
+	log.Printf("Error: Request missing a required parameter")
+	return Response{StatusCode: 400,
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin":      "*",
+			"Access-Control-Allow-Credentials": "true",
+		},
+	}, nil
+}
+
+type LocalServer struct{}
+
+func (l *LocalServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("Error reading request body: %v", err)
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("Failed to write body: %v", err)))
+		return
+	}
+
+	url, err := url.Parse(r.URL.String())
+	if err != nil {
+		log.Printf("Error parsing query string: %v", err)
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("Malformed query string: %v", err)))
+		return
+	}
+	queryParams := url.Query()
+
+	//**building request**
+	req := events.APIGatewayProxyRequest{
+		Body:                  string(body),
+		Headers:               make(map[string]string),
+		HTTPMethod:            r.Method,
+		Path:                  r.URL.Path,
+		QueryStringParameters: make(map[string]string),
+	}
+
+	//map raw request headers
+	for k, v := range r.Header {
+		req.Headers[strings.ToLower(k)] = v[0]
+	}
+
+	//Map raw query params
+	for k, v := range queryParams {
+		req.QueryStringParameters[strings.ToLower(k)] = v[0]
+	}
+
+	resp, err := Handler(r.Context(), req)
+	if err != nil {
+		log.Printf("Error handling request: %v", err)
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("Error handling request: %v", err)))
+		return
+	}
+	for k, v := range resp.Headers {
+		w.Header().Add(k, v)
+	}
+	(w).Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(resp.StatusCode)
+	w.Write([]byte(resp.Body))
+}
+
+func local() {
+	server := &LocalServer{}
+	fmt.Println("Starting local dev server on :8080")
+	http.ListenAndServe(":8080", server)
+}
+
+func main() {
+	if os.Getenv("AWS_LAMBDA_FUNCTION_NAME") == "" {
+		//see local creds file for env vars
+		local()
+	} else {
+		// Make the handler available for Remote Procedure Call by AWS Lambda
+		lambda.Start(Handler)
+	}
+}
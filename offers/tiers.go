@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/addauda/bubble-rewards-storefront-api/apikey"
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// TierRequest is the body of a new reward tier. A tier replaces the offer's
+// instant and/or loyalty reward for submissions with at least MinFollowers
+type TierRequest struct {
+	OfferID         json.Number `json:"offer_id"`
+	Name            string      `json:"name"`
+	MinFollowers    *int        `json:"min_followers"`
+	InstantRewardID *int        `json:"instant_reward_id"`
+	LoyaltyRewardID *int        `json:"loyalty_reward_id"`
+}
+
+// Tier is a reward tier of an offer, with the descriptions of its rewards
+type Tier struct {
+	ID                       int       `json:"id"`
+	OfferID                  int       `json:"offerId"`
+	Name                     string    `json:"name"`
+	MinFollowers             int       `json:"minFollowers"`
+	InstantRewardID          *int      `json:"instantRewardId,omitempty"`
+	InstantRewardDescription *string   `json:"instantRewardDescription,omitempty"`
+	LoyaltyRewardID          *int      `json:"loyaltyRewardId,omitempty"`
+	LoyaltyRewardDescription *string   `json:"loyaltyRewardDescription,omitempty"`
+	CreatedAt                time.Time `json:"createdAt"`
+}
+
+// Tiers lists reward tiers
+type Tiers struct {
+	Tiers []Tier `json:"tiers"`
+}
+
+// GenerateTiersQuery lists the tiers of a store's offers, or of offer $2, or
+// the one with id $3, lowest threshold first
+func GenerateTiersQuery() string {
+	return "SELECT offer_reward_tiers.id, offer_reward_tiers.offer_id, offer_reward_tiers.name, offer_reward_tiers.min_followers, instant.id, instant.description, loyalty.id, loyalty.description, offer_reward_tiers.created_at from offer_reward_tiers join offers on offer_reward_tiers.offer_id = offers.id left join rewards instant on offer_reward_tiers.instant_reward_id = instant.id left join rewards loyalty on offer_reward_tiers.loyalty_reward_id = loyalty.id WHERE offers.store_id = $1 AND ($2::integer IS NULL OR offer_reward_tiers.offer_id = $2) AND ($3::integer IS NULL OR offer_reward_tiers.id = $3) ORDER BY offer_reward_tiers.offer_id, offer_reward_tiers.min_followers"
+}
+
+// GenerateThresholdTakenQuery checks whether an offer already has a tier at a
+// follower threshold
+func GenerateThresholdTakenQuery() string {
+	return "SELECT EXISTS (SELECT 1 from offer_reward_tiers WHERE offer_id = $1 AND min_followers = $2)"
+}
+
+// GenerateCreateTierQuery creates a reward tier
+func GenerateCreateTierQuery() string {
+	return "INSERT INTO offer_reward_tiers (offer_id, name, min_followers, instant_reward_id, loyalty_reward_id) VALUES ($1, $2, $3, $4, $5) RETURNING id"
+}
+
+// GenerateDeleteTierQuery deletes a tier of one of a store's offers
+func GenerateDeleteTierQuery() string {
+	return "DELETE FROM offer_reward_tiers USING offers WHERE offer_reward_tiers.offer_id = offers.id AND offer_reward_tiers.id = $1 AND offers.store_id = $2 RETURNING offer_reward_tiers.offer_id"
+}
+
+// parseTier reads and checks a new tier. A tier has to replace at least one
+// of the offer's rewards, or it would change nothing
+func parseTier(body string) (TierRequest, *Refusal) {
+	var tier TierRequest
+	if err := json.Unmarshal([]byte(body), &tier); err != nil {
+		log.Printf("Error: Malformed request body: %v", err)
+		return tier, &Refusal{StatusCode: 400, Code: "INVALID_REQUEST", Message: "Malformed request body"}
+	}
+
+	tier.Name = strings.TrimSpace(tier.Name)
+	if _, err := tier.OfferID.Int64(); err != nil || tier.Name == "" || tier.MinFollowers == nil {
+		return tier, &Refusal{StatusCode: 400, Code: "INVALID_REQUEST", Message: "offer_id, name and min_followers are required"}
+	}
+	if *tier.MinFollowers < 0 {
+		return tier, &Refusal{StatusCode: 400, Code: "INVALID_REQUEST", Message: "min_followers can't be negative"}
+	}
+	if tier.InstantRewardID == nil && tier.LoyaltyRewardID == nil {
+		return tier, &Refusal{StatusCode: 400, Code: "INVALID_REQUEST", Message: "instant_reward_id or loyalty_reward_id is required"}
+	}
+	return tier, nil
+}
+
+// listTiers reads the tiers of a store's offers, narrowed to an offer or a
+// single tier when offerID or id is set
+func listTiers(q Queryer, storeID int, offerID sql.NullString, id sql.NullInt64) (Tiers, error) {
+	list := Tiers{Tiers: []Tier{}}
+	rows, err := q.Query(GenerateTiersQuery(), storeID, offerID, id)
+	if err != nil {
+		return list, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tier Tier
+		if err = rows.Scan(&tier.ID, &tier.OfferID, &tier.Name, &tier.MinFollowers, &tier.InstantRewardID, &tier.InstantRewardDescription, &tier.LoyaltyRewardID, &tier.LoyaltyRewardDescription, &tier.CreatedAt); err != nil {
+			return list, err
+		}
+		list.Tiers = append(list.Tiers, tier)
+	}
+	return list, rows.Err()
+}
+
+// createTier adds a tier to an offer of the calling store within tx. The
+// offer stays locked until tx ends, so two tiers can't race for a threshold
+func createTier(tx *sql.Tx, storeID int, body TierRequest) (Tier, *Refusal, error) {
+	offerID := body.OfferID.String()
+	var ownerID int
+	switch err := tx.QueryRow(GenerateLockOfferQuery(), offerID).Scan(&ownerID); err {
+	case sql.ErrNoRows:
+		return Tier{}, &Refusal{StatusCode: 404, Code: "NOT_FOUND", Message: "Offer not found"}, nil
+	case nil:
+	default:
+		return Tier{}, nil, err
+	}
+	if ownerID != storeID {
+		return Tier{}, &Refusal{StatusCode: 403, Code: "WRONG_STORE", Message: "Offer belongs to another store"}, nil
+	}
+
+	refusal, err := checkReferences(tx, OfferRequest{InstantRewardID: body.InstantRewardID, LoyaltyRewardID: body.LoyaltyRewardID})
+	if err != nil || refusal != nil {
+		return Tier{}, refusal, err
+	}
+
+	var taken bool
+	if err = tx.QueryRow(GenerateThresholdTakenQuery(), offerID, *body.MinFollowers).Scan(&taken); err != nil {
+		return Tier{}, nil, err
+	}
+	if taken {
+		return Tier{}, &Refusal{StatusCode: 409, Code: "DUPLICATE_THRESHOLD", Message: fmt.Sprintf("Offer already has a tier at %d followers", *body.MinFollowers)}, nil
+	}
+
+	var id int64
+	if err = tx.QueryRow(GenerateCreateTierQuery(), offerID, body.Name, *body.MinFollowers, body.InstantRewardID, body.LoyaltyRewardID).Scan(&id); err != nil {
+		return Tier{}, nil, err
+	}
+
+	list, err := listTiers(tx, storeID, sql.NullString{}, sql.NullInt64{Int64: id, Valid: true})
+	if err != nil {
+		return Tier{}, nil, err
+	}
+	if len(list.Tiers) != 1 {
+		return Tier{}, nil, fmt.Errorf("tier [%d] not found after saving", id)
+	}
+	log.Printf("Success: Added tier [%d] at %d followers to offer [%s]", id, *body.MinFollowers, offerID)
+	return list.Tiers[0], nil, nil
+}
+
+// deleteTier removes a tier of one of the calling store's offers and lists
+// the tiers the offer has left
+func deleteTier(db *sql.DB, storeID int, id int) (Tiers, *Refusal, error) {
+	var offerID string
+	switch err := db.QueryRow(GenerateDeleteTierQuery(), id, storeID).Scan(&offerID); err {
+	case sql.ErrNoRows:
+		return Tiers{}, &Refusal{StatusCode: 404, Code: "NOT_FOUND", Message: "Tier not found"}, nil
+	case nil:
+	default:
+		return Tiers{}, nil, err
+	}
+	log.Printf("Success: Deleted tier [%d] of offer [%s]", id, offerID)
+
+	list, err := listTiers(db, storeID, sql.NullString{String: offerID, Valid: true}, sql.NullInt64{})
+	return list, nil, err
+}
+
+// TiersHandler manages the reward tiers of the store's offers. GET lists
+// them, POST adds one and DELETE removes one
+func TiersHandler(ctx context.Context, request events.APIGatewayProxyRequest) (Response, error) {
+
+	apiKey := request.QueryStringParameters["api_key"]
+	method := request.HTTPMethod
+
+	// Ensure all fields are not empty
+	if apiKey != "" && (method == "GET" || method == "POST" || method == "DELETE") {
+
+		log.Printf("Info: Request method %s", method)
+		log.Printf("Info: Request API key %s", apikey.Visible(apiKey))
+
+		// Malformed tiers and ids would otherwise only fail in Postgres, as
+		// a 500
+		var tier TierRequest
+		var offerID sql.NullString
+		var id int
+		switch method {
+		case "GET":
+			if o := request.QueryStringParameters["offer_id"]; o != "" {
+				if _, err := strconv.ParseInt(o, 10, 32); err != nil {
+					return refusalResponse(&Refusal{StatusCode: 400, Code: "INVALID_REQUEST", Message: "offer_id must be an integer"})
+				}
+				offerID = sql.NullString{String: o, Valid: true}
+			}
+		case "POST":
+			var refusal *Refusal
+			if tier, refusal = parseTier(request.Body); refusal != nil {
+				return refusalResponse(refusal)
+			}
+		case "DELETE":
+			var err error
+			if id, err = strconv.Atoi(request.QueryStringParameters["id"]); err != nil || id < 1 {
+				return refusalResponse(&Refusal{StatusCode: 400, Code: "INVALID_REQUEST", Message: "A tier id is required"})
+			}
+		}
+
+		// Connect to database
+		connStr := fmt.Sprintf("host=%s user=%s password=%s dbname=%s sslmode=disable",
+			os.Getenv("DB_HOST"), os.Getenv("DB_USER"), os.Getenv("DB_PASSWORD"), os.Getenv("DB_NAME"))
+
+		db, err := sql.Open("postgres", connStr)
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		defer db.Close()
+
+		// Validate API key
+		storeID, storeName, err := apikey.Authenticate(db, apiKey)
+		switch err {
+		case apikey.ErrInvalid:
+			log.Printf("Error: No store with API key [%s] was found", apikey.Visible(apiKey))
+			return Response{StatusCode: 401,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		case nil:
+			log.Printf("Info: Retreived store as [%s]", storeName)
+		default:
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		var result interface{}
+		var refusal *Refusal
+		switch method {
+		case "GET":
+			result, err = listTiers(db, storeID, offerID, sql.NullInt64{})
+		case "POST":
+			var tx *sql.Tx
+			if tx, err = db.BeginTx(ctx, nil); err == nil {
+				result, refusal, err = createTier(tx, storeID, tier)
+				if err == nil && refusal == nil {
+					err = tx.Commit()
+				} else {
+					tx.Rollback()
+				}
+			}
+		case "DELETE":
+			result, refusal, err = deleteTier(db, storeID, id)
+		}
+
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		if refusal != nil {
+			log.Printf("Error: Tier change refused as [%s]", refusal.Code)
+			return refusalResponse(refusal)
+		}
+
+		//Generate message that want to be sent as body
+		message, err := json.Marshal(result)
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		//Returning response with AWS Lambda Proxy Response
+		return Response{StatusCode: 200,
+			Body: string(message),
+			Headers: map[string]string{
+				"Access-Control-Allow-Origin":      "*",
+				"Access-Control-Allow-Credentials": "true",
+			},
+		}, nil
+	}
+
+	// Missing one of required parameters
+	log.Printf("Error: Request missing a required parameter")
+	return Response{StatusCode: 400,
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin":      "*",
+			"Access-Control-Allow-Credentials": "true",
+		},
+	}, nil
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/addauda/bubble-rewards-storefront-api/apikey"
+	"github.com/addauda/bubble-rewards-storefront-api/token"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	_ "github.com/lib/pq"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// Response is of type APIGatewayProxyResponse since we're leveraging the
+// AWS Lambda Proxy Request functionality (default behavior)
+//
+// https://serverless.com/framework/docs/providers/aws/events/apigateway/#lambda-proxy-integration
+type Response events.APIGatewayProxyResponse
+
+const expiration = time.Hour
+
+// Bounds and default for the rendered image width in pixels
+const (
+	defaultSize = 256
+	minSize     = 64
+	maxSize     = 1024
+)
+
+var client = &http.Client{}
+
+// levels maps the error correction query parameter to a recovery level
+var levels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+// GenerateCouponQuery reads a coupon's status and expiry along with the store
+// owning it
+func GenerateCouponQuery() string {
+	return "SELECT redemptions_coupon.status, redemptions_coupon.expire_at, offers.store_id from redemptions_coupon join submissions on redemptions_coupon.submission_id = submissions.id join offers on submissions.offer_id = offers.id WHERE redemptions_coupon.id = $1"
+}
+
+// renderSVG draws the QR code as an SVG of the given width, one square per
+// dark module
+func renderSVG(q *qrcode.QRCode, size int) string {
+	bitmap := q.Bitmap()
+	var path strings.Builder
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&path, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	return fmt.Sprintf("<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" viewBox=\"0 0 %d %d\" shape-rendering=\"crispEdges\"><rect width=\"%d\" height=\"%d\" fill=\"#ffffff\"/><path d=\"%s\" fill=\"#000000\"/></svg>",
+		size, size, len(bitmap), len(bitmap), len(bitmap), len(bitmap), path.String())
+}
+
+// KeysHandler publishes the public keys tokens are verified with, so that a
+// POS can verify them offline, along with the id of the key new tokens are
+// signed with
+func KeysHandler(ctx context.Context, request events.APIGatewayProxyRequest) (Response, error) {
+	verifyKeys, err := token.VerifyKeysFromEnv()
+	if err != nil {
+		log.Printf("Error: %v", err)
+		return Response{StatusCode: 500,
+			Headers: map[string]string{
+				"Access-Control-Allow-Origin":      "*",
+				"Access-Control-Allow-Credentials": "true",
+			},
+		}, nil
+	}
+	keyring, err := token.KeyringFromEnv()
+	if err != nil {
+		log.Printf("Error: %v", err)
+		return Response{StatusCode: 500,
+			Headers: map[string]string{
+				"Access-Control-Allow-Origin":      "*",
+				"Access-Control-Allow-Credentials": "true",
+			},
+		}, nil
+	}
+
+	keys := make(map[string]string)
+	for id, key := range verifyKeys {
+		keys[id] = base64.StdEncoding.EncodeToString(key)
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"activeKeyId": keyring.ActiveKeyID,
+		"keys":        keys,
+	})
+	if err != nil {
+		log.Printf("Error: %v", err)
+		return Response{StatusCode: 500,
+			Headers: map[string]string{
+				"Access-Control-Allow-Origin":      "*",
+				"Access-Control-Allow-Credentials": "true",
+			},
+		}, nil
+	}
+
+	//Returning response with AWS Lambda Proxy Response
+	return Response{StatusCode: 200,
+		Body: string(body),
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin":      "*",
+			"Access-Control-Allow-Credentials": "true",
+		},
+	}, nil
+}
+
+// Handler is our lambda handler invoked by the `lambda.Start` function call
+func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (Response, error) {
+
+	if strings.HasSuffix(request.Path, "/keys") {
+		return KeysHandler(ctx, request)
+	}
+
+	id := request.QueryStringParameters["id"]
+	apiKey := request.QueryStringParameters["api_key"]
+
+	format := request.QueryStringParameters["format"]
+	if format == "" {
+		format = "png"
+	}
+	level := request.QueryStringParameters["level"]
+	if level == "" {
+		level = "M"
+	}
+	size := defaultSize
+	if s := request.QueryStringParameters["size"]; s != "" {
+		var err error
+		if size, err = strconv.Atoi(s); err != nil {
+			size = 0
+		}
+	}
+
+	// Ensure all fields are not empty
+	if id != "" && apiKey != "" {
+
+		log.Printf("Info: Request id %s", id)
+		log.Printf("Info: Request format %s, size %d, level %s", format, size, level)
+		log.Printf("Info: Request API key %s", apikey.Visible(apiKey))
+
+		recoveryLevel, ok := levels[strings.ToUpper(level)]
+		if !ok || (format != "png" && format != "svg") || size < minSize || size > maxSize {
+			log.Printf("Error: Invalid format [%s], size [%d] or level [%s]", format, size, level)
+			return Response{StatusCode: 400,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		// An id outside the id column's range would fail the lookup as a 500
+		couponID, err := strconv.ParseInt(id, 10, 32)
+		if err != nil || couponID < 1 {
+			log.Printf("Error: Invalid coupon ID [%s]", id)
+			return Response{StatusCode: 400,
+				Body: " { \"error\" : \"INVALID_ID\", \"message\" : \"Id must be a positive integer\" } ",
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		// Connect to database
+		connStr := fmt.Sprintf("host=%s user=%s password=%s dbname=%s sslmode=disable",
+			os.Getenv("DB_HOST"), os.Getenv("DB_USER"), os.Getenv("DB_PASSWORD"), os.Getenv("DB_NAME"))
+
+		db, err := sql.Open("postgres", connStr)
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		defer db.Close()
+
+		// Validate API key
+		storeID, storeName, err := apikey.Authenticate(db, apiKey)
+		switch err {
+		case apikey.ErrInvalid:
+			log.Printf("Error: No store with API key [%s] was found", apikey.Visible(apiKey))
+			return Response{StatusCode: 401,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		case nil:
+			log.Printf("Info: Retreived store as [%s]", storeName)
+		default:
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		// Look up the coupon and make sure it belongs to the store
+		var couponStatus string
+		var expireAt time.Time
+		var ownerID int
+		row := db.QueryRow(GenerateCouponQuery(), couponID)
+		switch err = row.Scan(&couponStatus, &expireAt, &ownerID); err {
+		case sql.ErrNoRows:
+			log.Printf("Error: Coupon ID [%s] NOT FOUND", id)
+			return Response{StatusCode: 404,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		case nil:
+			if ownerID != storeID {
+				log.Printf("Error: Coupon ID [%s] belongs to another store", id)
+				return Response{StatusCode: 403,
+					Body: " { \"error\" : \"WRONG_STORE\", \"message\" : \"Redemption belongs to another store\" } ",
+					Headers: map[string]string{
+						"Access-Control-Allow-Origin":      "*",
+						"Access-Control-Allow-Credentials": "true",
+					},
+				}, nil
+			}
+		default:
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		// A token verifies offline until it expires, so none is signed for a
+		// coupon that can no longer be redeemed
+		if couponStatus == "EXPIRED" || (couponStatus == "PENDING" && !time.Now().Before(expireAt)) {
+			log.Printf("Error: Coupon ID [%s] has expired", id)
+			return Response{StatusCode: 410,
+				Body: fmt.Sprintf(" { \"error\" : \"EXPIRED\", \"message\" : \"Coupon has expired\", \"expireAt\" : \"%s\" } ", expireAt.Format(time.RFC3339)),
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+		if couponStatus != "PENDING" {
+			log.Printf("Error: Coupon ID [%s] is %s", id, couponStatus)
+			return Response{StatusCode: 409,
+				Body: fmt.Sprintf(" { \"error\" : \"NOT_REDEEMABLE\", \"message\" : \"Coupon is %s\" } ", couponStatus),
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		// The payload is a signed token so a POS can verify it offline. A
+		// token signed with a key that is not yet published as a verify key
+		// would be refused everywhere, so none is signed
+		keyring, err := token.KeyringFromEnv()
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+		verifyKeys, err := token.VerifyKeysFromEnv()
+		if err == nil && !keyring.PublicKeys()[keyring.ActiveKeyID].Equal(verifyKeys[keyring.ActiveKeyID]) {
+			err = fmt.Errorf("active signing key [%s] is not among the verify keys", keyring.ActiveKeyID)
+		}
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		payload, err := keyring.Issue(int(couponID), storeID, expireAt)
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		q, err := qrcode.New(payload, recoveryLevel)
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		log.Printf("Success: Rendered coupon ID [%s] as %s", id, format)
+		if format == "svg" {
+			return Response{StatusCode: 200,
+				Body: renderSVG(q, size),
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+					"Content-Type":                     "image/svg+xml",
+				},
+			}, nil
+		}
+
+		png, err := q.PNG(size)
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		//Returning binary response with AWS Lambda Proxy Response
+		return Response{StatusCode: 200,
+			Body:            base64.StdEncoding.EncodeToString(png),
+			IsBase64Encoded: true,
+			Headers: map[string]string{
+				"Access-Control-Allow-Origin":      "*",
+				"Access-Control-Allow-Credentials": "true",
+				"Content-Type":                     "image/png",
+			},
+		}, nil
+	}
+
+	// Missing one of required parameters
+	log.Printf("Error: Request missing a required parameter")
+	return Response{StatusCode: 400,
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin":      "*",
+			"Access-Control-Allow-Credentials": "true",
+		},
+	}, nil
+}
+
+type LocalServer struct{}
+
+func (l *LocalServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("Error reading request body: %v", err)
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("Failed to write body: %v", err)))
+		return
+	}
+
+	url, err := url.Parse(r.URL.String())
+	if err != nil {
+		log.Printf("Error parsing query string: %v", err)
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("Malformed query string: %v", err)))
+		return
+	}
+	queryParams := url.Query()
+
+	//**building request**
+	req := events.APIGatewayProxyRequest{
+		Body:                  string(body),
+		Headers:               make(map[string]string),
+		HTTPMethod:            r.Method,
+		Path:                  r.URL.Path,
+		QueryStringParameters: make(map[string]string),
+	}
+
+	//map raw request headers
+	for k, v := range r.Header {
+		req.Headers[strings.ToLower(k)] = v[0]
+	}
+
+	//Map raw query params
+	for k, v := range queryParams {
+		req.QueryStringParameters[strings.ToLower(k)] = v[0]
+	}
+
+	resp, err := Handler(r.Context(), req)
+	if err != nil {
+		log.Printf("Error handling request: %v", err)
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("Error handling request: %v", err)))
+		return
+	}
+	for k, v := range resp.Headers {
+		w.Header().Add(k, v)
+	}
+	(w).Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(resp.StatusCode)
+	if resp.IsBase64Encoded {
+		body, _ := base64.StdEncoding.DecodeString(resp.Body)
+		w.Write(body)
+		return
+	}
+	w.Write([]byte(resp.Body))
+}
+
+func local() {
+	server := &LocalServer{}
+	fmt.Println("Starting local dev server on :8080")
+	http.ListenAndServe(":8080", server)
+}
+
+func main() {
+	if os.Getenv("AWS_LAMBDA_FUNCTION_NAME") == "" {
+		//see local creds file for env vars
+		local()
+	} else {
+		// Make the handler available for Remote Procedure Call by AWS Lambda
+		lambda.Start(Handler)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/addauda/bubble-rewards-storefront-api/apikey"
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// maxBatchItems caps how many redemptions a single batch can carry
+const maxBatchItems = 100
+
+// BatchRequest is the body of a batch redemption. With AllOrNothing set the
+// batch is only applied when every item can be redeemed
+type BatchRequest struct {
+	AllOrNothing bool            `json:"all_or_nothing"`
+	Items        []RedeemRequest `json:"items"`
+}
+
+// BatchResult reports the outcome of one item of a batch
+type BatchResult struct {
+	ID             string          `json:"id"`
+	RedemptionType string          `json:"redemptionType"`
+	Status         string          `json:"status"`
+	Redemption     json.RawMessage `json:"redemption,omitempty"`
+	Refusal        *Refusal        `json:"refusal,omitempty"`
+}
+
+// BatchResponse is the body returned for a batch redemption
+type BatchResponse struct {
+	Committed bool          `json:"committed"`
+	Results   []BatchResult `json:"results"`
+}
+
+// batchStatus summarizes a refusal as the status of a batch item
+func batchStatus(refusal *Refusal) string {
+	switch refusal.Code {
+	case "NOT_FOUND", "EXPIRED":
+		return refusal.Code
+	case "ALREADY_REDEEMED", "CONFLICT":
+		return "CONFLICT"
+	}
+	return "REFUSED"
+}
+
+// redeemBatch redeems each item under its own savepoint within tx so that a
+// refused item leaves the others in place. In all-or-nothing mode a single
+// refusal rolls the whole batch back
+func redeemBatch(tx *sql.Tx, storeID int, batch BatchRequest) (Response, error) {
+	if _, err := tx.Exec("SAVEPOINT batch"); err != nil {
+		return Response{}, err
+	}
+
+	results := make([]BatchResult, 0, len(batch.Items))
+	failed := false
+	for _, item := range batch.Items {
+		result := BatchResult{ID: item.ID.String(), RedemptionType: item.RedemptionType}
+		if !validID(result.ID) || (item.RedemptionType != "COUPON" && item.RedemptionType != "INSTANT") {
+			result.Status = "INVALID"
+			results = append(results, result)
+			failed = true
+			continue
+		}
+
+		if _, err := tx.Exec("SAVEPOINT batch_item"); err != nil {
+			return Response{}, err
+		}
+		message, refusal, err := redeemItem(tx, storeID, item.RedemptionType, result.ID, Origin{})
+		if err != nil {
+			return Response{}, err
+		}
+
+		if refusal != nil {
+			if _, err = tx.Exec("ROLLBACK TO SAVEPOINT batch_item"); err != nil {
+				return Response{}, err
+			}
+			result.Status = batchStatus(refusal)
+			result.Refusal = refusal
+			failed = true
+		} else {
+			if _, err = tx.Exec("RELEASE SAVEPOINT batch_item"); err != nil {
+				return Response{}, err
+			}
+			result.Status = "SUCCESS"
+			result.Redemption = json.RawMessage(message)
+		}
+		results = append(results, result)
+	}
+
+	statusCode := 200
+	committed := true
+	if batch.AllOrNothing && failed {
+		log.Printf("Error: Rolling back all-or-nothing batch")
+		if _, err := tx.Exec("ROLLBACK TO SAVEPOINT batch"); err != nil {
+			return Response{}, err
+		}
+		for i := range results {
+			if results[i].Status == "SUCCESS" {
+				results[i].Status = "ROLLED_BACK"
+			}
+		}
+		statusCode = 422
+		committed = false
+	}
+
+	body, err := json.Marshal(BatchResponse{Committed: committed, Results: results})
+	if err != nil {
+		return Response{}, err
+	}
+
+	//Returning response with AWS Lambda Proxy Response
+	return Response{StatusCode: statusCode,
+		Body: string(body),
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin":      "*",
+			"Access-Control-Allow-Credentials": "true",
+		},
+	}, nil
+}
+
+// BatchHandler redeems a list of coupons and submissions in one request
+func BatchHandler(ctx context.Context, request events.APIGatewayProxyRequest) (Response, error) {
+
+	apiKey := request.QueryStringParameters["api_key"]
+	idempotencyKey := header(request.Headers, "Idempotency-Key")
+
+	var batch BatchRequest
+	if err := json.Unmarshal([]byte(request.Body), &batch); err != nil {
+		log.Printf("Error: Malformed request body: %v", err)
+		return Response{StatusCode: 400,
+			Headers: map[string]string{
+				"Access-Control-Allow-Origin":      "*",
+				"Access-Control-Allow-Credentials": "true",
+			},
+		}, nil
+	}
+
+	// Ensure all fields are not empty
+	if request.HTTPMethod == "POST" && len(batch.Items) > 0 && apiKey != "" && idempotencyKey != "" {
+
+		log.Printf("Info: Request batch of %d items", len(batch.Items))
+		log.Printf("Info: Request all or nothing %t", batch.AllOrNothing)
+		log.Printf("Info: Request API key %s", apikey.Visible(apiKey))
+		log.Printf("Info: Request idempotency key %s", idempotencyKey)
+
+		if len(batch.Items) > maxBatchItems {
+			log.Printf("Error: Batch exceeds %d items", maxBatchItems)
+			return Response{StatusCode: 400,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		// Connect to database
+		connStr := fmt.Sprintf("host=%s user=%s password=%s dbname=%s sslmode=disable",
+			os.Getenv("DB_HOST"), os.Getenv("DB_USER"), os.Getenv("DB_PASSWORD"), os.Getenv("DB_NAME"))
+
+		db, err := sql.Open("postgres", connStr)
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		defer db.Close()
+
+		// Validate API key
+		storeID, storeName, err := apikey.Authenticate(db, apiKey)
+		switch err {
+		case apikey.ErrInvalid:
+			log.Printf("Error: No store with API key [%s] was found", apikey.Visible(apiKey))
+			return Response{StatusCode: 401,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		case nil:
+			log.Printf("Info: Retreived store as [%s]", storeName)
+		default:
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		digest := sha256.Sum256([]byte(request.Body))
+		resp, err := once(tx, storeID, idempotencyKey, "BATCH:"+hex.EncodeToString(digest[:]), func() (Response, error) {
+			return redeemBatch(tx, storeID, batch)
+		})
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		return resp, nil
+	}
+
+	// Missing one of required parameters
+	log.Printf("Error: Request missing a required parameter")
+	return Response{StatusCode: 400,
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin":      "*",
+			"Access-Control-Allow-Credentials": "true",
+		},
+	}, nil
+}
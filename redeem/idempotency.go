@@ -0,0 +1,82 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+)
+
+// GenerateClaimIdempotencyKeyQuery records an idempotency key for the store,
+// reclaiming it when it was last used more than 24 hours ago. No row is
+// returned while the key is still live
+func GenerateClaimIdempotencyKeyQuery() string {
+	return "INSERT INTO idempotency_keys (idempotency_key, store_id, request) VALUES ($1, $2, $3) ON CONFLICT (store_id, idempotency_key) DO UPDATE SET request = EXCLUDED.request, status_code = NULL, response_body = NULL, created_at = current_timestamp WHERE idempotency_keys.created_at < current_timestamp - interval '24 hours' RETURNING id"
+}
+
+// GenerateIdempotentResponseQuery reads the response stored for a live key
+func GenerateIdempotentResponseQuery() string {
+	return "SELECT request, status_code, response_body from idempotency_keys WHERE idempotency_key = $1 AND store_id = $2"
+}
+
+// GenerateStoreIdempotentResponseQuery stores the response sent for a key
+func GenerateStoreIdempotentResponseQuery() string {
+	return "UPDATE idempotency_keys SET status_code = $1, response_body = $2 WHERE id = $3"
+}
+
+// once calls redeem within tx, replaying the stored response instead when the
+// store already used the idempotency key in the last 24 hours. request
+// identifies what is being redeemed so that a key cannot be reused for
+// something else. An empty key redeems without recording the response
+func once(tx *sql.Tx, storeID int, key string, request string, redeem func() (Response, error)) (Response, error) {
+	if key == "" {
+		return redeem()
+	}
+
+	// Concurrent requests with the same key block on the insert until the
+	// first one commits, and then replay its response
+	var keyID int
+	row := tx.QueryRow(GenerateClaimIdempotencyKeyQuery(), key, storeID, request)
+	switch err := row.Scan(&keyID); err {
+	case sql.ErrNoRows:
+		return replay(tx, storeID, key, request)
+	case nil:
+	default:
+		return Response{}, err
+	}
+
+	resp, err := redeem()
+	if err != nil {
+		return Response{}, err
+	}
+
+	if _, err = tx.Exec(GenerateStoreIdempotentResponseQuery(), resp.StatusCode, resp.Body, keyID); err != nil {
+		return Response{}, err
+	}
+	return resp, nil
+}
+
+// replay returns the response stored for a live idempotency key, refusing
+// keys that were used for a different redemption
+func replay(tx *sql.Tx, storeID int, key string, request string) (Response, error) {
+	var storedRequest string
+	var statusCode int
+	var body string
+	row := tx.QueryRow(GenerateIdempotentResponseQuery(), key, storeID)
+	if err := row.Scan(&storedRequest, &statusCode, &body); err != nil {
+		return Response{}, err
+	}
+
+	if storedRequest != request {
+		log.Printf("Error: Idempotency key [%s] was used for [%s]", key, storedRequest)
+		return refusalResponse(&Refusal{StatusCode: 422, Code: "IDEMPOTENCY_KEY_REUSED", Message: "Idempotency key was used for a different redemption"})
+	}
+
+	log.Printf("Info: Replaying response for idempotency key [%s]", key)
+	return Response{StatusCode: statusCode,
+		Body: body,
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin":      "*",
+			"Access-Control-Allow-Credentials": "true",
+			"Idempotent-Replayed":              "true",
+		},
+	}, nil
+}
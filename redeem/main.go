@@ -3,15 +3,18 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/addauda/bubble-rewards-storefront-api/apikey"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	_ "github.com/lib/pq"
@@ -27,27 +30,347 @@ const expiration = time.Hour
 
 var client = &http.Client{}
 
+// Refusal explains why a redemption was refused. ExpireAt is set when it was
+// refused for having expired and Redemption carries the original redemption
+// when the refusal is caused by an earlier one
+type Refusal struct {
+	StatusCode int             `json:"-"`
+	Code       string          `json:"error"`
+	Message    string          `json:"message"`
+	ExpireAt   string          `json:"expireAt,omitempty"`
+	Redemption json.RawMessage `json:"redemption,omitempty"`
+}
+
+// CouponRedemption describes a use of a coupon. Ids and counts are sent as
+// strings, as they always have been
+type CouponRedemption struct {
+	RedemptionID      int    `json:"redemptionID,string"`
+	RedemptionCode    string `json:"redemptionCode"`
+	RedemptionTime    string `json:"redemptionTime"`
+	RemainingUses     int    `json:"remainingUses,string"`
+	RewardDescription string `json:"rewardDescription"`
+	TierName          string `json:"tierName"`
+}
+
+// InstantRedemption describes the redemption of a submission's instant reward
+type InstantRedemption struct {
+	RedemptionID      int    `json:"redemptionID,string"`
+	SubmissionID      int    `json:"submissionId,string"`
+	RedemptionTime    string `json:"redemptionTime"`
+	RewardDescription string `json:"rewardDescription"`
+	TierName          string `json:"tierName"`
+}
+
+// Origin says which device redeemed and when. Online redemptions leave both
+// unset and are stamped with the database clock
+type Origin struct {
+	DeviceID   sql.NullString
+	RedeemedAt sql.NullTime
+}
+
+// GenerateLockCouponQuery reads a coupon with its offer and locks the coupon
+// row until the surrounding transaction ends. Expiry is judged at $2, or now
+// when it is null
+func GenerateLockCouponQuery() string {
+	return "SELECT redemptions_coupon.status, redemptions_coupon.expire_at, redemptions_coupon.expire_at <= COALESCE($2::timestamptz, current_timestamp), offers.status, offers.store_id from redemptions_coupon join submissions on redemptions_coupon.submission_id = submissions.id join offers on submissions.offer_id = offers.id WHERE redemptions_coupon.id = $1 FOR UPDATE OF redemptions_coupon"
+}
+
+// GenerateLockSubmissionQuery reads a submission with its offer and locks the
+// submission row until the surrounding transaction ends. Expiry is judged at
+// $2, or now when it is null
+func GenerateLockSubmissionQuery() string {
+	return "SELECT submissions.status, submissions.instant_reward_expire_at, submissions.instant_reward_expire_at <= COALESCE($2::timestamptz, current_timestamp), offers.status, offers.store_id from submissions join offers on submissions.offer_id = offers.id WHERE submissions.id = $1 FOR UPDATE OF submissions"
+}
+
+// GenerateRedeemCouponCodeQuery uses up one use of a coupon at $3, or now
+// when it is null, marking it REDEEMED once no uses remain. redeemed_at keeps
+// the latest use, which a late synced offline use may predate
 func GenerateRedeemCouponCodeQuery() string {
-	return "UPDATE redemptions_coupon SET status = 'REDEEMED', redeemed_at = current_timestamp WHERE id = $1 AND status = 'PENDING' RETURNING id, code, redeemed_at"
+	return "UPDATE redemptions_coupon SET use_count = redemptions_coupon.use_count + 1, status = CASE WHEN redemptions_coupon.use_count + 1 >= redemptions_coupon.max_uses THEN 'REDEEMED' ELSE redemptions_coupon.status END, redeemed_at = GREATEST(redemptions_coupon.redeemed_at, COALESCE($3::timestamptz, current_timestamp)) FROM submissions, offers, rewards WHERE redemptions_coupon.submission_id = submissions.id AND submissions.offer_id = offers.id AND submissions.loyalty_reward_id = rewards.id AND redemptions_coupon.id = $1 AND offers.store_id = $2 AND redemptions_coupon.status = 'PENDING' AND COALESCE($3::timestamptz, current_timestamp) < redemptions_coupon.expire_at RETURNING redemptions_coupon.id, redemptions_coupon.code, COALESCE($3::timestamptz, current_timestamp), redemptions_coupon.max_uses - redemptions_coupon.use_count, rewards.description, submissions.tier_name"
+}
+
+// GenerateRecordCouponUseQuery logs a single use of a coupon
+func GenerateRecordCouponUseQuery() string {
+	return "INSERT INTO redemptions_coupon_uses (coupon_id, redeemed_at, device_id) VALUES ($1, $2, $3)"
+}
+
+// GenerateInstantRedemptionQuery finds an earlier instant redemption of a
+// submission
+func GenerateInstantRedemptionQuery() string {
+	return "SELECT redemptions_instant.id, redemptions_instant.submission_id, redemptions_instant.redeemed_at, rewards.description, submissions.tier_name from redemptions_instant join submissions on submissions.id = redemptions_instant.submission_id join rewards on submissions.instant_reward_id = rewards.id WHERE redemptions_instant.submission_id = $1"
 }
 
+// GenerateRedeemInstantQuery records an instant redemption at $3, or now when
+// it is null, made by device $4
 func GenerateRedeemInstantQuery() string {
-	return "INSERT INTO redemptions_instant (submission_id, redeemed_at) select submissions.id, current_timestamp from submissions where id = $1 AND status = 'ACCEPTED' RETURNING id, submission_id, redeemed_at;"
+	return "WITH redeemed AS (INSERT INTO redemptions_instant (submission_id, redeemed_at, device_id) select submissions.id, COALESCE($3::timestamptz, current_timestamp), $4::text from submissions join offers on submissions.offer_id = offers.id where submissions.id = $1 AND offers.store_id = $2 AND submissions.status = 'ACCEPTED' AND COALESCE($3::timestamptz, current_timestamp) < submissions.instant_reward_expire_at RETURNING id, submission_id, redeemed_at) " +
+		"SELECT redeemed.id, redeemed.submission_id, redeemed.redeemed_at, rewards.description, submissions.tier_name from redeemed join submissions on submissions.id = redeemed.submission_id join rewards on submissions.instant_reward_id = rewards.id"
+}
+
+// refuse checks a locked redemption against the calling store and returns
+// the reason it cannot be redeemed, or nil when it can
+func refuse(storeID int, ownerID int, status string, redeemableStatus string, expireAt string, expired bool, offerStatus string) *Refusal {
+	switch {
+	case ownerID != storeID:
+		return &Refusal{StatusCode: 403, Code: "WRONG_STORE", Message: "Redemption belongs to another store"}
+	case status == "REDEEMED":
+		return &Refusal{StatusCode: 409, Code: "ALREADY_REDEEMED", Message: "Redemption has already been redeemed"}
+	case status == "EXPIRED" || expired:
+		return &Refusal{StatusCode: 410, Code: "EXPIRED", Message: "Redemption has expired", ExpireAt: expireAt}
+	case offerStatus != "ACTIVE":
+		return &Refusal{StatusCode: 422, Code: "OFFER_INACTIVE", Message: "Offer is no longer active"}
+	case status != redeemableStatus:
+		return &Refusal{StatusCode: 422, Code: "NOT_REDEEMABLE", Message: fmt.Sprintf("Redemption is %s", status)}
+	}
+	return nil
+}
+
+// redeemCoupon locks the coupon, checks that the calling store may redeem it
+// and marks it redeemed, all within tx
+func redeemCoupon(tx *sql.Tx, id string, storeID int, origin Origin) (string, *Refusal, error) {
+	var couponStatus string
+	var expireAt string
+	var expired bool
+	var offerStatus string
+	var ownerID int
+	row := tx.QueryRow(GenerateLockCouponQuery(), id, origin.RedeemedAt)
+	switch err := row.Scan(&couponStatus, &expireAt, &expired, &offerStatus, &ownerID); err {
+	case sql.ErrNoRows:
+		return "", &Refusal{StatusCode: 404, Code: "NOT_FOUND", Message: "Coupon not found"}, nil
+	case nil:
+	default:
+		return "", nil, err
+	}
+
+	if refusal := refuse(storeID, ownerID, couponStatus, "PENDING", expireAt, expired, offerStatus); refusal != nil {
+		return "", refusal, nil
+	}
+
+	var redemption CouponRedemption
+	var tierName sql.NullString
+	row = tx.QueryRow(GenerateRedeemCouponCodeQuery(), id, storeID, origin.RedeemedAt)
+	switch err := row.Scan(&redemption.RedemptionID, &redemption.RedemptionCode, &redemption.RedemptionTime, &redemption.RemainingUses, &redemption.RewardDescription, &tierName); err {
+	case sql.ErrNoRows:
+		return "", &Refusal{StatusCode: 409, Code: "CONFLICT", Message: "Coupon was redeemed concurrently"}, nil
+	case nil:
+	default:
+		return "", nil, err
+	}
+
+	redemption.TierName = tierName.String
+
+	if _, err := tx.Exec(GenerateRecordCouponUseQuery(), redemption.RedemptionID, redemption.RedemptionTime, origin.DeviceID); err != nil {
+		return "", nil, err
+	}
+
+	log.Printf("Success: Redeemed code [%s] with [%d] uses remaining", redemption.RedemptionCode, redemption.RemainingUses)
+	message, err := json.Marshal(redemption)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(message), nil, nil
+}
+
+// redeemInstant locks the submission, checks that the calling store may
+// redeem its instant reward and records the redemption, all within tx
+func redeemInstant(tx *sql.Tx, id string, storeID int, origin Origin) (string, *Refusal, error) {
+	var submissionStatus string
+	var expireAt string
+	var expired bool
+	var offerStatus string
+	var ownerID int
+	row := tx.QueryRow(GenerateLockSubmissionQuery(), id, origin.RedeemedAt)
+	switch err := row.Scan(&submissionStatus, &expireAt, &expired, &offerStatus, &ownerID); err {
+	case sql.ErrNoRows:
+		return "", &Refusal{StatusCode: 404, Code: "NOT_FOUND", Message: "Submission not found"}, nil
+	case nil:
+	default:
+		return "", nil, err
+	}
+
+	// Each submission can only be redeemed once, hand back the original. This
+	// comes before the expiry and offer checks so that a repeat still gets
+	// the original once the reward has expired or the offer is paused
+	var redemption InstantRedemption
+	var redemptionTime sql.NullString
+	var tierName sql.NullString
+	if ownerID == storeID {
+		row = tx.QueryRow(GenerateInstantRedemptionQuery(), id)
+		switch err := row.Scan(&redemption.RedemptionID, &redemption.SubmissionID, &redemptionTime, &redemption.RewardDescription, &tierName); err {
+		case sql.ErrNoRows:
+		case nil:
+			redemption.RedemptionTime, redemption.TierName = redemptionTime.String, tierName.String
+			original, err := json.Marshal(redemption)
+			if err != nil {
+				return "", nil, err
+			}
+			return "", &Refusal{StatusCode: 409, Code: "ALREADY_REDEEMED", Message: "Submission has already been redeemed", Redemption: original}, nil
+		default:
+			return "", nil, err
+		}
+	}
+
+	if refusal := refuse(storeID, ownerID, submissionStatus, "ACCEPTED", expireAt, expired, offerStatus); refusal != nil {
+		return "", refusal, nil
+	}
+
+	row = tx.QueryRow(GenerateRedeemInstantQuery(), id, storeID, origin.RedeemedAt, origin.DeviceID)
+	switch err := row.Scan(&redemption.RedemptionID, &redemption.SubmissionID, &redemption.RedemptionTime, &redemption.RewardDescription, &tierName); err {
+	case sql.ErrNoRows:
+		return "", &Refusal{StatusCode: 409, Code: "CONFLICT", Message: "Submission was redeemed concurrently"}, nil
+	case nil:
+	default:
+		return "", nil, err
+	}
+	redemption.TierName = tierName.String
+
+	log.Printf("Success: Redeemed submission [%d]", redemption.SubmissionID)
+	message, err := json.Marshal(redemption)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(message), nil, nil
+}
+
+// refusalResponse builds an error response with a machine readable error code
+func refusalResponse(refusal *Refusal) (Response, error) {
+	body, err := json.Marshal(refusal)
+	if err != nil {
+		return Response{}, err
+	}
+	return Response{StatusCode: refusal.StatusCode,
+		Body: string(body),
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin":      "*",
+			"Access-Control-Allow-Credentials": "true",
+		},
+	}, nil
+}
+
+// RedeemRequest is the body of a POST redemption
+type RedeemRequest struct {
+	ID             json.Number `json:"id"`
+	RedemptionType string      `json:"redemption_type"`
+}
+
+// redeemItem dispatches to the redemption type within tx
+func redeemItem(tx *sql.Tx, storeID int, redemptionType string, id string, origin Origin) (string, *Refusal, error) {
+	log.Printf("Info: Redeeming type [%s]", redemptionType)
+	var message string
+	var refusal *Refusal
+	var err error
+	if redemptionType == "COUPON" {
+		message, refusal, err = redeemCoupon(tx, id, storeID, origin)
+	} else {
+		message, refusal, err = redeemInstant(tx, id, storeID, origin)
+	}
+	if err == nil && refusal != nil {
+		log.Printf("Error: Redemption [%s] refused as [%s]", id, refusal.Code)
+	}
+	return message, refusal, err
+}
+
+// redeem redeems a single coupon or submission and builds the response, all
+// within tx
+func redeem(tx *sql.Tx, storeID int, redemptionType string, id string) (Response, error) {
+	message, refusal, err := redeemItem(tx, storeID, redemptionType, id, Origin{})
+	if err != nil {
+		return Response{}, err
+	}
+
+	if refusal != nil {
+		return refusalResponse(refusal)
+	}
+
+	//Returning response with AWS Lambda Proxy Response
+	return Response{StatusCode: 200,
+		Body: message,
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin":      "*",
+			"Access-Control-Allow-Credentials": "true",
+		},
+	}, nil
+}
+
+// validID checks that an id is a positive integer that fits the id columns,
+// so that a malformed id is refused rather than failing in the database
+func validID(id string) bool {
+	n, err := strconv.ParseInt(id, 10, 32)
+	return err == nil && n > 0
+}
+
+// header looks up a request header regardless of how the client cased it
+func header(headers map[string]string, name string) string {
+	for k, v := range headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
 }
 
 // Handler is our lambda handler invoked by the `lambda.Start` function call
 func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (Response, error) {
 
-	id := request.QueryStringParameters["id"]
-	redemptionType := request.QueryStringParameters["redemption_type"]
+	if strings.HasSuffix(request.Path, "/batch") {
+		return BatchHandler(ctx, request)
+	}
+	if strings.HasSuffix(request.Path, "/sync") {
+		return SyncHandler(ctx, request)
+	}
+
 	apiKey := request.QueryStringParameters["api_key"]
 
+	var id string
+	var redemptionType string
+	var idempotencyKey string
+	deprecated := request.HTTPMethod != "POST"
+	if deprecated {
+		// GET is kept as a deprecated alias of POST without idempotency
+		id = request.QueryStringParameters["id"]
+		redemptionType = request.QueryStringParameters["redemption_type"]
+	} else {
+		var body RedeemRequest
+		if err := json.Unmarshal([]byte(request.Body), &body); err != nil {
+			log.Printf("Error: Malformed request body: %v", err)
+			return Response{StatusCode: 400,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+		id = body.ID.String()
+		redemptionType = body.RedemptionType
+		idempotencyKey = header(request.Headers, "Idempotency-Key")
+	}
+
 	// Ensure all fields are not empty
-	if id != "" && redemptionType != "" && apiKey != "" {
+	if id != "" && redemptionType != "" && apiKey != "" && (deprecated || idempotencyKey != "") {
 
 		log.Printf("Info: Request id %s", id)
 		log.Printf("Info: Request redemption type %s", redemptionType)
-		log.Printf("Info: Request API key %s", apiKey)
+		log.Printf("Info: Request API key %s", apikey.Visible(apiKey))
+		if deprecated {
+			log.Printf("Info: Request uses deprecated %s /redeem", request.HTTPMethod)
+		} else {
+			log.Printf("Info: Request idempotency key %s", idempotencyKey)
+		}
+
+		if redemptionType != "COUPON" && redemptionType != "INSTANT" {
+			log.Printf("Error: Invalid redemption type [%s]", redemptionType)
+			return Response{StatusCode: 400,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		if !validID(id) {
+			log.Printf("Error: Invalid id [%s]", id)
+			return refusalResponse(&Refusal{StatusCode: 400, Code: "INVALID_ID", Message: "Id must be a positive integer"})
+		}
 
 		// Connect to database
 		connStr := fmt.Sprintf("host=%s user=%s password=%s dbname=%s sslmode=disable",
@@ -67,12 +390,10 @@ func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (Respon
 		defer db.Close()
 
 		// Validate API key
-		var storeID int
-		var storeName string
-		row := db.QueryRow("SELECT id,name FROM stores WHERE api_key = $1", apiKey)
-		switch err = row.Scan(&storeID, &storeName); err {
-		case sql.ErrNoRows:
-			log.Printf("Error: No store with API key [%s] was found", apiKey)
+		storeID, storeName, err := apikey.Authenticate(db, apiKey)
+		switch err {
+		case apikey.ErrInvalid:
+			log.Printf("Error: No store with API key [%s] was found", apikey.Visible(apiKey))
 			return Response{StatusCode: 401,
 				Headers: map[string]string{
 					"Access-Control-Allow-Origin":      "*",
@@ -91,94 +412,42 @@ func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (Respon
 			}, nil
 		}
 
-		// Redeem a coupon code
-		if redemptionType == "COUPON" {
-			log.Printf("Info: Redeeming type [%s]", redemptionType)
-			var redemptionID int
-			var redemptionCode string
-			var redemptionTime string
-			row := db.QueryRow(GenerateRedeemCouponCodeQuery(), id)
-			switch err = row.Scan(&redemptionID, &redemptionCode, &redemptionTime); err {
-			case sql.ErrNoRows:
-				log.Printf("Error: Coupon ID [%s] NOT FOUND", id)
-				return Response{StatusCode: 404,
-					Headers: map[string]string{
-						"Access-Control-Allow-Origin":      "*",
-						"Access-Control-Allow-Credentials": "true",
-					},
-				}, nil
-			case nil:
-				log.Printf("Success: Redeemed code [%s]", redemptionCode)
-
-				//Generate message that want to be sent as body
-				message := fmt.Sprintf(" { \"redemptionID\" : \"%d\", \"redemptionCode\" : \"%s\", \"redemptionTime\" : \"%s\" } ", redemptionID, redemptionCode, redemptionTime)
-
-				//Returning response with AWS Lambda Proxy Response
-				return Response{StatusCode: 200,
-					Body: message,
-					Headers: map[string]string{
-						"Access-Control-Allow-Origin":      "*",
-						"Access-Control-Allow-Credentials": "true",
-					},
-				}, nil
-
-			default:
-				log.Printf("Error: %v", err)
-				return Response{StatusCode: 500,
-					Headers: map[string]string{
-						"Access-Control-Allow-Origin":      "*",
-						"Access-Control-Allow-Credentials": "true",
-					},
-				}, nil
-			}
-		} else if redemptionType == "INSTANT" {
-			log.Printf("Info: Redeeming type [%s]", redemptionType)
-			var redemptionID int
-			var submissionID int
-			var redemptionTime string
-			row := db.QueryRow(GenerateRedeemInstantQuery(), id)
-			switch err = row.Scan(&redemptionID, &submissionID, &redemptionTime); err {
-			case sql.ErrNoRows:
-				log.Printf("Error: Submission ID [%s] NOT FOUND", id)
-				return Response{StatusCode: 404,
-					Headers: map[string]string{
-						"Access-Control-Allow-Origin":      "*",
-						"Access-Control-Allow-Credentials": "true",
-					},
-				}, nil
-			case nil:
-				log.Printf("Success: Redeemed submission [%d]", submissionID)
-
-				//Generate message that want to be sent as body
-				message := fmt.Sprintf(" { \"redemptionID\" : \"%d\", \"submissionId\" : \"%d\", \"redemptionTime\" : \"%s\" } ", redemptionID, submissionID, redemptionTime)
-
-				//Returning response with AWS Lambda Proxy Response
-				return Response{StatusCode: 200,
-					Body: message,
-					Headers: map[string]string{
-						"Access-Control-Allow-Origin":      "*",
-						"Access-Control-Allow-Credentials": "true",
-					},
-				}, nil
-
-			default:
-				log.Printf("Error: %v", err)
-				return Response{StatusCode: 500,
-					Headers: map[string]string{
-						"Access-Control-Allow-Origin":      "*",
-						"Access-Control-Allow-Credentials": "true",
-					},
-				}, nil
-			}
+		// Validate and redeem within one transaction so that concurrent
+		// cashiers cannot both redeem the same coupon or submission
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		resp, err := once(tx, storeID, idempotencyKey, redemptionType+":"+id, func() (Response, error) {
+			return redeem(tx, storeID, redemptionType, id)
+		})
+		if err == nil {
+			err = tx.Commit()
 		} else {
-			log.Printf("Error: Invalid redemption type [%s]", redemptionType)
-			return Response{StatusCode: 400,
+			tx.Rollback()
+		}
+
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
 				Headers: map[string]string{
 					"Access-Control-Allow-Origin":      "*",
 					"Access-Control-Allow-Credentials": "true",
 				},
 			}, nil
 		}
+
+		if deprecated {
+			resp.Headers["Deprecation"] = "true"
+		}
+		return resp, nil
 	}
 
 	// Missing one of required parameters
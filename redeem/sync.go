@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/addauda/bubble-rewards-storefront-api/apikey"
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// maxSyncItems caps how many offline redemptions a single upload can carry
+const maxSyncItems = 500
+
+// maxClockSkew is how far ahead of the server a device's clock may run
+const maxClockSkew = 5 * time.Minute
+
+// maxOfflineAge is how long after an offline redemption it may be synced
+const maxOfflineAge = 7 * 24 * time.Hour
+
+// OfflineRedemption is a redemption a POS accepted while offline. LocalID is
+// unique per device so an upload can safely be retried
+type OfflineRedemption struct {
+	LocalID        string      `json:"local_id"`
+	ID             json.Number `json:"id"`
+	RedemptionType string      `json:"redemption_type"`
+	RedeemedAt     time.Time   `json:"redeemed_at"`
+}
+
+// SyncRequest is the body of an offline redemption upload
+type SyncRequest struct {
+	DeviceID    string              `json:"device_id"`
+	Redemptions []OfflineRedemption `json:"redemptions"`
+}
+
+// Conflict describes the earlier redemption an offline one collided with
+type Conflict struct {
+	DeviceID   string `json:"deviceId,omitempty"`
+	RedeemedAt string `json:"redeemedAt"`
+}
+
+// SyncResult reconciles one offline redemption
+type SyncResult struct {
+	LocalID        string          `json:"localId"`
+	ID             string          `json:"id"`
+	RedemptionType string          `json:"redemptionType"`
+	RedeemedAt     time.Time       `json:"redeemedAt"`
+	Status         string          `json:"status"`
+	Replayed       bool            `json:"replayed,omitempty"`
+	Redemption     json.RawMessage `json:"redemption,omitempty"`
+	Refusal        *Refusal        `json:"refusal,omitempty"`
+	Conflict       *Conflict       `json:"conflict,omitempty"`
+}
+
+// SyncResponse is the reconciliation report returned for an upload
+type SyncResponse struct {
+	DeviceID  string       `json:"deviceId"`
+	Applied   int          `json:"applied"`
+	Conflicts int          `json:"conflicts"`
+	Results   []SyncResult `json:"results"`
+}
+
+// GenerateClaimOfflineRedemptionQuery records an offline redemption unless
+// the device already synced it
+func GenerateClaimOfflineRedemptionQuery() string {
+	return "INSERT INTO offline_redemptions (store_id, device_id, local_id, redemption_type, redemption_id, redeemed_at) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (store_id, device_id, local_id) DO NOTHING RETURNING id"
+}
+
+// GenerateOfflineResultQuery reads the result of an already synced offline
+// redemption
+func GenerateOfflineResultQuery() string {
+	return "SELECT result from offline_redemptions WHERE store_id = $1 AND device_id = $2 AND local_id = $3"
+}
+
+// GenerateStoreOfflineResultQuery stores the result of an offline redemption
+func GenerateStoreOfflineResultQuery() string {
+	return "UPDATE offline_redemptions SET status = $1, result = $2 WHERE id = $3"
+}
+
+// GenerateLastCouponUseQuery finds the latest use of a coupon
+func GenerateLastCouponUseQuery() string {
+	return "SELECT device_id, redeemed_at from redemptions_coupon_uses WHERE coupon_id = $1 ORDER BY redeemed_at DESC, id DESC LIMIT 1"
+}
+
+// GenerateInstantRedeemerQuery finds who redeemed a submission
+func GenerateInstantRedeemerQuery() string {
+	return "SELECT device_id, redeemed_at from redemptions_instant WHERE submission_id = $1"
+}
+
+// conflictWith looks up the redemption an offline one collided with
+func conflictWith(tx *sql.Tx, redemptionType string, id string) (*Conflict, error) {
+	query := GenerateLastCouponUseQuery()
+	if redemptionType == "INSTANT" {
+		query = GenerateInstantRedeemerQuery()
+	}
+
+	var deviceID sql.NullString
+	var redeemedAt sql.NullString
+	switch err := tx.QueryRow(query, id).Scan(&deviceID, &redeemedAt); err {
+	case sql.ErrNoRows:
+		return nil, nil
+	case nil:
+		return &Conflict{DeviceID: deviceID.String, RedeemedAt: redeemedAt.String}, nil
+	default:
+		return nil, err
+	}
+}
+
+// syncStatus summarizes a refusal as the status of an offline redemption.
+// Anything already redeemed by the time it syncs was spent twice
+func syncStatus(refusal *Refusal) string {
+	switch refusal.Code {
+	case "ALREADY_REDEEMED", "CONFLICT":
+		return "DOUBLE_SPEND"
+	case "NOT_FOUND", "EXPIRED":
+		return refusal.Code
+	}
+	return "REFUSED"
+}
+
+// applyOffline applies a single offline redemption under a savepoint, as of
+// the time and device it was made on
+func applyOffline(tx *sql.Tx, storeID int, deviceID string, item OfflineRedemption, now time.Time) (SyncResult, error) {
+	result := SyncResult{LocalID: item.LocalID, ID: item.ID.String(), RedemptionType: item.RedemptionType, RedeemedAt: item.RedeemedAt}
+	if item.LocalID == "" || !validID(result.ID) || (item.RedemptionType != "COUPON" && item.RedemptionType != "INSTANT") ||
+		item.RedeemedAt.After(now.Add(maxClockSkew)) || item.RedeemedAt.Before(now.Add(-maxOfflineAge)) {
+		result.Status = "INVALID"
+		return result, nil
+	}
+
+	// Retried uploads get the original result back
+	var offlineID int
+	row := tx.QueryRow(GenerateClaimOfflineRedemptionQuery(), storeID, deviceID, item.LocalID, item.RedemptionType, result.ID, item.RedeemedAt)
+	switch err := row.Scan(&offlineID); err {
+	case sql.ErrNoRows:
+		var stored string
+		if err = tx.QueryRow(GenerateOfflineResultQuery(), storeID, deviceID, item.LocalID).Scan(&stored); err != nil {
+			return result, err
+		}
+		if err = json.Unmarshal([]byte(stored), &result); err != nil {
+			return result, err
+		}
+		result.Replayed = true
+		return result, nil
+	case nil:
+	default:
+		return result, err
+	}
+
+	if _, err := tx.Exec("SAVEPOINT sync_item"); err != nil {
+		return result, err
+	}
+	origin := Origin{
+		DeviceID:   sql.NullString{String: deviceID, Valid: true},
+		RedeemedAt: sql.NullTime{Time: item.RedeemedAt, Valid: true},
+	}
+	message, refusal, err := redeemItem(tx, storeID, item.RedemptionType, result.ID, origin)
+	if err != nil {
+		return result, err
+	}
+
+	if refusal != nil {
+		if _, err = tx.Exec("ROLLBACK TO SAVEPOINT sync_item"); err != nil {
+			return result, err
+		}
+		result.Status = syncStatus(refusal)
+		result.Refusal = refusal
+		if result.Status == "DOUBLE_SPEND" {
+			log.Printf("Error: Offline redemption [%s] from device [%s] was spent twice", item.LocalID, deviceID)
+			if result.Conflict, err = conflictWith(tx, item.RedemptionType, result.ID); err != nil {
+				return result, err
+			}
+		}
+	} else {
+		if _, err = tx.Exec("RELEASE SAVEPOINT sync_item"); err != nil {
+			return result, err
+		}
+		result.Status = "APPLIED"
+		result.Redemption = json.RawMessage(message)
+	}
+
+	stored, err := json.Marshal(result)
+	if err != nil {
+		return result, err
+	}
+	if _, err = tx.Exec(GenerateStoreOfflineResultQuery(), result.Status, string(stored), offlineID); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// syncOffline applies a device's offline redemptions in the order they were
+// made and reports on each
+func syncOffline(tx *sql.Tx, storeID int, sync SyncRequest) (Response, error) {
+	sort.SliceStable(sync.Redemptions, func(i, j int) bool {
+		return sync.Redemptions[i].RedeemedAt.Before(sync.Redemptions[j].RedeemedAt)
+	})
+
+	report := SyncResponse{DeviceID: sync.DeviceID, Results: make([]SyncResult, 0, len(sync.Redemptions))}
+	now := time.Now()
+	for _, item := range sync.Redemptions {
+		result, err := applyOffline(tx, storeID, sync.DeviceID, item, now)
+		if err != nil {
+			return Response{}, err
+		}
+		switch result.Status {
+		case "APPLIED":
+			report.Applied++
+		case "DOUBLE_SPEND":
+			report.Conflicts++
+		}
+		report.Results = append(report.Results, result)
+	}
+
+	body, err := json.Marshal(report)
+	if err != nil {
+		return Response{}, err
+	}
+
+	//Returning response with AWS Lambda Proxy Response
+	return Response{StatusCode: 200,
+		Body: string(body),
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin":      "*",
+			"Access-Control-Allow-Credentials": "true",
+		},
+	}, nil
+}
+
+// SyncHandler applies redemptions a POS accepted while it was offline
+func SyncHandler(ctx context.Context, request events.APIGatewayProxyRequest) (Response, error) {
+
+	apiKey := request.QueryStringParameters["api_key"]
+
+	var sync SyncRequest
+	if err := json.Unmarshal([]byte(request.Body), &sync); err != nil {
+		log.Printf("Error: Malformed request body: %v", err)
+		return Response{StatusCode: 400,
+			Headers: map[string]string{
+				"Access-Control-Allow-Origin":      "*",
+				"Access-Control-Allow-Credentials": "true",
+			},
+		}, nil
+	}
+
+	// Ensure all fields are not empty
+	if request.HTTPMethod == "POST" && sync.DeviceID != "" && len(sync.Redemptions) > 0 && apiKey != "" {
+
+		log.Printf("Info: Request device %s", sync.DeviceID)
+		log.Printf("Info: Request %d offline redemptions", len(sync.Redemptions))
+		log.Printf("Info: Request API key %s", apikey.Visible(apiKey))
+
+		if len(sync.Redemptions) > maxSyncItems {
+			log.Printf("Error: Upload exceeds %d redemptions", maxSyncItems)
+			return Response{StatusCode: 400,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		// Connect to database
+		connStr := fmt.Sprintf("host=%s user=%s password=%s dbname=%s sslmode=disable",
+			os.Getenv("DB_HOST"), os.Getenv("DB_USER"), os.Getenv("DB_PASSWORD"), os.Getenv("DB_NAME"))
+
+		db, err := sql.Open("postgres", connStr)
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		defer db.Close()
+
+		// Validate API key
+		storeID, storeName, err := apikey.Authenticate(db, apiKey)
+		switch err {
+		case apikey.ErrInvalid:
+			log.Printf("Error: No store with API key [%s] was found", apikey.Visible(apiKey))
+			return Response{StatusCode: 401,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		case nil:
+			log.Printf("Info: Retreived store as [%s]", storeName)
+		default:
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		resp, err := syncOffline(tx, storeID, sync)
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		return resp, nil
+	}
+
+	// Missing one of required parameters
+	log.Printf("Error: Request missing a required parameter")
+	return Response{StatusCode: 400,
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin":      "*",
+			"Access-Control-Allow-Credentials": "true",
+		},
+	}, nil
+}
@@ -1,22 +1,34 @@
 /* Rollback tables */
+DROP VIEW IF EXISTS public.submission_rewards;
+DROP TABLE IF EXISTS public.expired_redemptions;
+DROP TABLE IF EXISTS public.expiry_sweeps;
+DROP TABLE IF EXISTS public.offline_redemptions;
+DROP TABLE IF EXISTS public.redemption_voids;
+DROP TABLE IF EXISTS public.redemptions_coupon_uses;
+DROP TABLE IF EXISTS public.idempotency_keys;
 DROP TABLE IF EXISTS public.redemptions_instant;
 DROP TABLE IF EXISTS public.redemptions_coupon;
 DROP TABLE IF EXISTS public.submissions;
+DROP TABLE IF EXISTS public.offer_reward_tiers;
 DROP TABLE IF EXISTS public.offers;
 DROP TABLE IF EXISTS public.rewards;
 DROP TABLE IF EXISTS public.actions;
+DROP TABLE IF EXISTS public.api_keys;
 DROP TABLE IF EXISTS public.stores;
+DROP FUNCTION IF EXISTS normalize_submission_handle();
+DROP FUNCTION IF EXISTS normalize_instagram_handle(text);
 DROP TYPE IF EXISTS "status";
+DROP TYPE IF EXISTS void_reason;
 
 CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
 CREATE TYPE "status" AS ENUM ('ACTIVE', 'INACTIVE', 'EXPIRED', 'REDEEMED', 'PENDING', 'ACCEPTED', 'REJECTED');
+CREATE TYPE void_reason AS ENUM ('WRONG_REDEMPTION', 'WRONG_CUSTOMER', 'DUPLICATE', 'CUSTOMER_REQUEST', 'OTHER');
 
 CREATE TABLE public.stores (
 	id SERIAL PRIMARY KEY,
 	"name" text NOT NULL,
 	postal_code VARCHAR(8) NOT NULL,
 	metadata jsonb,
-	api_key uuid UNIQUE NOT NULL DEFAULT uuid_generate_v4(),
 	"status" status NOT NULL DEFAULT 'ACTIVE',
 	created_at timestamptz NOT NULL DEFAULT now(),
 	updated_at timestamptz NOT NULL DEFAULT now()
@@ -26,6 +38,20 @@ INSERT INTO public.stores (id, name, postal_code)
 VALUES
  (1,'Tehanos Grill','M1B1K4');
 
+CREATE TABLE public.api_keys (
+	id SERIAL PRIMARY KEY,
+	store_id INTEGER REFERENCES stores(id) NOT NULL,
+	prefix VARCHAR(12) NOT NULL,
+	key_hash CHAR(64) UNIQUE NOT NULL,
+	label text NOT NULL,
+	created_at timestamptz NOT NULL DEFAULT now(),
+	last_used_at timestamptz,
+	expire_at timestamptz,
+	revoked_at timestamptz
+);
+
+CREATE INDEX api_keys_store ON public.api_keys (store_id);
+
 CREATE TABLE public.actions (
 	id SERIAL PRIMARY KEY,
 	"description" text NOT NULL,
@@ -52,6 +78,10 @@ VALUES
  (2, 'Free Fries');
 
 
+/* Full text search over the catalog, matching the catalog endpoint's queries */
+CREATE INDEX actions_search ON public.actions USING GIN (to_tsvector('english', description || ' ' || COALESCE(keywords, '')));
+CREATE INDEX rewards_search ON public.rewards USING GIN (to_tsvector('english', description || ' ' || COALESCE(keywords, '')));
+
 CREATE TABLE public.offers (
 	id SERIAL PRIMARY KEY,
 	"status" status NOT NULL DEFAULT 'ACTIVE',
@@ -59,6 +89,9 @@ CREATE TABLE public.offers (
 	instant_reward_id INTEGER REFERENCES rewards(id) NOT NULL,
 	loyalty_reward_id INTEGER REFERENCES rewards(id) NOT NULL,
 	store_id INTEGER REFERENCES stores(id) NOT NULL,
+	coupon_validity interval NOT NULL DEFAULT interval '3 months' CHECK (coupon_validity > interval '0'),
+	coupon_uses INTEGER NOT NULL DEFAULT 1 CHECK (coupon_uses > 0),
+	instant_reward_validity interval NOT NULL DEFAULT interval '2 days' CHECK (instant_reward_validity > interval '0'),
 	created_at timestamptz NOT NULL DEFAULT now(),
 	updated_at timestamptz NOT NULL DEFAULT now()
 );
@@ -67,44 +100,173 @@ INSERT INTO public.offers (id, action_id, instant_reward_id, loyalty_reward_id,
 VALUES
  (1, 1, 1, 2, 1);
 
+CREATE TABLE public.offer_reward_tiers (
+	id SERIAL PRIMARY KEY,
+	offer_id INTEGER REFERENCES offers(id) NOT NULL,
+	"name" text NOT NULL,
+	min_followers INTEGER NOT NULL CHECK (min_followers >= 0),
+	instant_reward_id INTEGER REFERENCES rewards(id),
+	loyalty_reward_id INTEGER REFERENCES rewards(id),
+	created_at timestamptz NOT NULL DEFAULT now(),
+	updated_at timestamptz NOT NULL DEFAULT now(),
+	UNIQUE (offer_id, min_followers)
+);
+
 
 CREATE TABLE public.submissions (
 	id SERIAL PRIMARY KEY,
-	instagram_account VARCHAR(35) NOT NULL,
+	instagram_account VARCHAR(35) NOT NULL CHECK (instagram_account ~ '^@[a-z0-9_]+(\.[a-z0-9_]+)*$' AND char_length(instagram_account) <= 31),
 	follower_count INTEGER NOT NULL,
 	metadata jsonb DEFAULT '[{}]',
 	"status" status NOT NULL DEFAULT 'PENDING',
 	offer_id INTEGER REFERENCES offers(id) NOT NULL,
 	instant_reward_expire_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP + interval '2 day',
+	decision_reason text,
+	decided_by text,
+	decided_at timestamptz,
+	api_key_id INTEGER REFERENCES api_keys(id),
+	tier_name text,
+	instant_reward_id INTEGER REFERENCES rewards(id),
+	loyalty_reward_id INTEGER REFERENCES rewards(id),
 	created_at timestamptz NOT NULL DEFAULT now(),
 	updated_at timestamptz NOT NULL DEFAULT now()
 );
 
-INSERT INTO public.submissions (id, instagram_account, follower_count, offer_id)
+/* Instagram handles are stored as @ followed by the lowercased username,
+   matching handle.Normalize */
+CREATE FUNCTION normalize_instagram_handle(handle text) RETURNS text AS $$
+	SELECT '@' || lower(regexp_replace(btrim(handle, E' \t\n\r\x0B\f'), '^@', ''))
+$$ LANGUAGE sql IMMUTABLE STRICT;
+
+CREATE FUNCTION normalize_submission_handle() RETURNS trigger AS $$
+BEGIN
+	NEW.instagram_account := normalize_instagram_handle(NEW.instagram_account);
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER submissions_normalize_handle
+BEFORE INSERT OR UPDATE OF instagram_account ON public.submissions
+FOR EACH ROW EXECUTE PROCEDURE normalize_submission_handle();
+
+INSERT INTO public.submissions (id, instagram_account, follower_count, offer_id, instant_reward_id, loyalty_reward_id)
 VALUES
- (1, '@ahmed.dauda', 210, 1),
- (2, '@lolade.ship', 300, 1);
+ (1, '@ahmed.dauda', 210, 1, 1, 2),
+ (2, '@lolade.ship', 300, 1, 1, 2);
+
+/* The rewards a submission earns, from the highest tier of its offer its
+   follower count reaches, falling back to the offer's own rewards. They are
+   saved on the submission when it is accepted, which is what everything
+   else reads */
+CREATE VIEW public.submission_rewards AS
+SELECT submissions.id AS submission_id, tier.name AS tier_name,
+	COALESCE(tier.instant_reward_id, offers.instant_reward_id) AS instant_reward_id,
+	COALESCE(tier.loyalty_reward_id, offers.loyalty_reward_id) AS loyalty_reward_id
+FROM public.submissions
+JOIN public.offers ON submissions.offer_id = offers.id
+LEFT JOIN LATERAL (
+	SELECT offer_reward_tiers.name, offer_reward_tiers.instant_reward_id, offer_reward_tiers.loyalty_reward_id
+	FROM public.offer_reward_tiers
+	WHERE offer_reward_tiers.offer_id = offers.id AND offer_reward_tiers.min_followers <= submissions.follower_count
+	ORDER BY offer_reward_tiers.min_followers DESC
+	LIMIT 1
+) tier ON true;
 
 CREATE TABLE public.redemptions_instant (
 	id SERIAL PRIMARY KEY,
-	submission_id INTEGER REFERENCES submissions(id) NOT NULL,
-	redeemed_at timestamptz
+	submission_id INTEGER REFERENCES submissions(id) UNIQUE NOT NULL,
+	redeemed_at timestamptz,
+	device_id text
 );
 
+CREATE INDEX redemptions_instant_redeemed_at ON public.redemptions_instant (redeemed_at);
+
 INSERT INTO public.redemptions_instant (submission_id)
 VALUES
  (1);
 
 CREATE TABLE public.redemptions_coupon (
 	id SERIAL PRIMARY KEY,
-	code VARCHAR(5) NOT NULL DEFAULT UPPER(LEFT(MD5(random()::text),4)),
+	code VARCHAR(16) NOT NULL,
 	"status" status NOT NULL DEFAULT 'PENDING',
 	submission_id INTEGER REFERENCES submissions(id) NOT NULL,
 	expire_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP + interval '3 months',
+	max_uses INTEGER NOT NULL DEFAULT 1 CHECK (max_uses > 0),
+	use_count INTEGER NOT NULL DEFAULT 0 CHECK (use_count >= 0 AND use_count <= max_uses),
 	created_at timestamptz NOT NULL DEFAULT now(),
 	redeemed_at timestamptz
 );
 
-INSERT INTO public.redemptions_coupon (id, submission_id)
+/* Codes are generated by the coupon package, only one active coupon may hold a code */
+CREATE UNIQUE INDEX redemptions_coupon_active_code ON public.redemptions_coupon (code) WHERE "status" = 'PENDING';
+
+INSERT INTO public.redemptions_coupon (id, code, submission_id)
 VALUES
- (1, 2);
\ No newline at end of file
+ (1, 'K7MQ4R', 2);
+
+CREATE TABLE public.redemptions_coupon_uses (
+	id SERIAL PRIMARY KEY,
+	coupon_id INTEGER REFERENCES redemptions_coupon(id) NOT NULL,
+	redeemed_at timestamptz NOT NULL DEFAULT now(),
+	device_id text
+);
+
+CREATE INDEX redemptions_coupon_uses_redeemed_at ON public.redemptions_coupon_uses (redeemed_at);
+
+CREATE TABLE public.idempotency_keys (
+	id SERIAL PRIMARY KEY,
+	idempotency_key VARCHAR(255) NOT NULL,
+	store_id INTEGER REFERENCES stores(id) NOT NULL,
+	request text NOT NULL,
+	status_code INTEGER,
+	response_body text,
+	created_at timestamptz NOT NULL DEFAULT now(),
+	UNIQUE (store_id, idempotency_key)
+);
+
+CREATE TABLE public.redemption_voids (
+	id SERIAL PRIMARY KEY,
+	redemption_type VARCHAR(7) NOT NULL,
+	coupon_id INTEGER REFERENCES redemptions_coupon(id),
+	submission_id INTEGER REFERENCES submissions(id) NOT NULL,
+	redeemed_at timestamptz,
+	reason void_reason NOT NULL,
+	note text,
+	voided_by text NOT NULL,
+	store_id INTEGER REFERENCES stores(id) NOT NULL,
+	api_key_id INTEGER REFERENCES api_keys(id),
+	voided_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX redemption_voids_store_redeemed_at ON public.redemption_voids (store_id, redeemed_at);
+
+CREATE TABLE public.offline_redemptions (
+	id SERIAL PRIMARY KEY,
+	store_id INTEGER REFERENCES stores(id) NOT NULL,
+	device_id text NOT NULL,
+	local_id text NOT NULL,
+	redemption_type VARCHAR(7) NOT NULL,
+	redemption_id text NOT NULL,
+	redeemed_at timestamptz NOT NULL,
+	"status" VARCHAR(16),
+	result text,
+	synced_at timestamptz NOT NULL DEFAULT now(),
+	UNIQUE (store_id, device_id, local_id)
+);
+
+CREATE TABLE public.expiry_sweeps (
+	id SERIAL PRIMARY KEY,
+	started_at timestamptz NOT NULL DEFAULT now(),
+	finished_at timestamptz,
+	coupons_expired INTEGER,
+	submissions_expired INTEGER
+);
+
+CREATE TABLE public.expired_redemptions (
+	id SERIAL PRIMARY KEY,
+	sweep_id INTEGER REFERENCES expiry_sweeps(id) NOT NULL,
+	redemption_type VARCHAR(7) NOT NULL,
+	redemption_id INTEGER NOT NULL,
+	expire_at timestamptz NOT NULL,
+	expired_at timestamptz NOT NULL DEFAULT now()
+);
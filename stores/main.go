@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/addauda/bubble-rewards-storefront-api/apikey"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	_ "github.com/lib/pq"
+)
+
+// Response is of type APIGatewayProxyResponse since we're leveraging the
+// AWS Lambda Proxy Request functionality (default behavior)
+//
+// https://serverless.com/framework/docs/providers/aws/events/apigateway/#lambda-proxy-integration
+type Response events.APIGatewayProxyResponse
+
+const expiration = time.Hour
+
+// maxMetadataSize caps the metadata stored with a store
+const maxMetadataSize = 4096
+
+var client = &http.Client{}
+
+// postalCode matches a Canadian postal code once spaces are removed
+var postalCode = regexp.MustCompile(`^[ABCEGHJ-NPRSTVXY][0-9][ABCEGHJ-NPRSTV-Z][0-9][ABCEGHJ-NPRSTV-Z][0-9]$`)
+
+// StoreRequest is the body of a new store
+type StoreRequest struct {
+	Name       string          `json:"name"`
+	PostalCode string          `json:"postal_code"`
+	Metadata   json.RawMessage `json:"metadata"`
+}
+
+// KeyRequest is the body of a key issued to an existing store, e.g. to
+// rotate out a leaked key
+type KeyRequest struct {
+	StoreID       json.Number `json:"store_id"`
+	Label         string      `json:"label"`
+	ExpiresInDays *int        `json:"expires_in_days"`
+}
+
+// Store is a newly onboarded store, carrying its first API key. The key is
+// not returned anywhere else
+type Store struct {
+	ID         string          `json:"id"`
+	Name       string          `json:"name"`
+	PostalCode string          `json:"postalCode"`
+	Metadata   json.RawMessage `json:"metadata,omitempty"`
+	Status     string          `json:"status"`
+	APIKey     string          `json:"apiKey"`
+	Key        apikey.Key      `json:"key"`
+	CreatedAt  time.Time       `json:"createdAt"`
+}
+
+// IssuedKey is a key issued to an existing store
+type IssuedKey struct {
+	StoreID string     `json:"storeId"`
+	APIKey  string     `json:"apiKey"`
+	Key     apikey.Key `json:"key"`
+}
+
+// GenerateCreateStoreQuery creates a store
+func GenerateCreateStoreQuery() string {
+	return "INSERT INTO stores (name, postal_code, metadata) VALUES ($1, $2, $3::jsonb) RETURNING id, status, created_at"
+}
+
+// GenerateStoreExistsQuery checks that a store exists, locking it
+func GenerateStoreExistsQuery() string {
+	return "SELECT id from stores WHERE id = $1 FOR UPDATE"
+}
+
+// GenerateRevokeKeyQuery revokes a key that is not yet revoked
+func GenerateRevokeKeyQuery() string {
+	return "UPDATE api_keys SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL RETURNING id, store_id, prefix, label, created_at, last_used_at, expire_at, revoked_at"
+}
+
+// errorResponse builds an error response with a machine readable error code
+func errorResponse(statusCode int, code string, message string) Response {
+	return Response{StatusCode: statusCode,
+		Body: fmt.Sprintf(" { \"error\" : \"%s\", \"message\" : \"%s\" } ", code, message),
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin":      "*",
+			"Access-Control-Allow-Credentials": "true",
+		},
+	}
+}
+
+// authorized checks the bearer token against ADMIN_API_KEY. Nothing is
+// authorized while ADMIN_API_KEY is unset
+func authorized(headers map[string]string) bool {
+	adminKey := os.Getenv("ADMIN_API_KEY")
+	var authorization string
+	for k, v := range headers {
+		if strings.EqualFold(k, "Authorization") {
+			authorization = v
+		}
+	}
+	presented := strings.TrimPrefix(authorization, "Bearer ")
+	return adminKey != "" && presented != authorization && subtle.ConstantTimeCompare([]byte(presented), []byte(adminKey)) == 1
+}
+
+// parseStore reads and checks a new store, tidying its name and postal code
+func parseStore(body string) (StoreRequest, *Response) {
+	var store StoreRequest
+	if err := json.Unmarshal([]byte(body), &store); err != nil {
+		log.Printf("Error: Malformed request body: %v", err)
+		resp := errorResponse(400, "INVALID_REQUEST", "Malformed request body")
+		return store, &resp
+	}
+
+	store.Name = strings.TrimSpace(store.Name)
+	store.PostalCode = strings.ToUpper(strings.Replace(store.PostalCode, " ", "", -1))
+	if store.Name == "" {
+		resp := errorResponse(400, "INVALID_REQUEST", "A name is required")
+		return store, &resp
+	}
+	if !postalCode.MatchString(store.PostalCode) {
+		resp := errorResponse(400, "INVALID_POSTAL_CODE", "Not a valid postal code")
+		return store, &resp
+	}
+
+	if metadata := bytes.TrimSpace(store.Metadata); len(metadata) == 0 || bytes.Equal(metadata, []byte("null")) {
+		store.Metadata = nil
+	} else if metadata[0] != '{' || len(metadata) > maxMetadataSize {
+		resp := errorResponse(400, "INVALID_METADATA", fmt.Sprintf("Metadata must be a JSON object of at most %d bytes", maxMetadataSize))
+		return store, &resp
+	}
+	return store, nil
+}
+
+// parseKey reads and checks a key to issue, which expires_in_days days out
+// when set
+func parseKey(body string) (KeyRequest, *Response) {
+	var key KeyRequest
+	if err := json.Unmarshal([]byte(body), &key); err != nil {
+		log.Printf("Error: Malformed request body: %v", err)
+		resp := errorResponse(400, "INVALID_REQUEST", "Malformed request body")
+		return key, &resp
+	}
+
+	key.Label = strings.TrimSpace(key.Label)
+	if _, err := key.StoreID.Int64(); err != nil || key.Label == "" {
+		resp := errorResponse(400, "INVALID_REQUEST", "A store_id and label are required")
+		return key, &resp
+	}
+	if key.ExpiresInDays != nil && *key.ExpiresInDays < 1 {
+		resp := errorResponse(400, "INVALID_REQUEST", "expires_in_days must be at least 1")
+		return key, &resp
+	}
+	return key, nil
+}
+
+// createStore creates a store with its first API key within tx
+func createStore(tx *sql.Tx, body StoreRequest) (Store, error) {
+	store := Store{Name: body.Name, PostalCode: body.PostalCode, Metadata: body.Metadata}
+	var metadata sql.NullString
+	if body.Metadata != nil {
+		metadata = sql.NullString{String: string(body.Metadata), Valid: true}
+	}
+	row := tx.QueryRow(GenerateCreateStoreQuery(), body.Name, body.PostalCode, metadata)
+	if err := row.Scan(&store.ID, &store.Status, &store.CreatedAt); err != nil {
+		return store, err
+	}
+
+	storeID, err := strconv.Atoi(store.ID)
+	if err != nil {
+		return store, err
+	}
+	store.Key, store.APIKey, err = apikey.Issue(tx, storeID, "Initial key", sql.NullTime{})
+	if err == nil {
+		log.Printf("Success: Onboarded store [%s] as [%s] with key [%s]", store.Name, store.ID, store.Key.Prefix)
+	}
+	return store, err
+}
+
+// issueKey issues an API key to an existing store within tx
+func issueKey(tx *sql.Tx, body KeyRequest) (*IssuedKey, error) {
+	issued := IssuedKey{StoreID: body.StoreID.String()}
+	var storeID int
+	switch err := tx.QueryRow(GenerateStoreExistsQuery(), issued.StoreID).Scan(&storeID); err {
+	case sql.ErrNoRows:
+		return nil, nil
+	case nil:
+	default:
+		return nil, err
+	}
+
+	var expireAt sql.NullTime
+	if body.ExpiresInDays != nil {
+		expireAt = sql.NullTime{Time: time.Now().AddDate(0, 0, *body.ExpiresInDays), Valid: true}
+	}
+
+	var err error
+	if issued.Key, issued.APIKey, err = apikey.Issue(tx, storeID, body.Label, expireAt); err != nil {
+		return nil, err
+	}
+	log.Printf("Success: Issued key [%s] to store [%d]", issued.Key.Prefix, storeID)
+	return &issued, nil
+}
+
+// RevokedKey is a key revoked by an admin
+type RevokedKey struct {
+	StoreID string     `json:"storeId"`
+	Key     apikey.Key `json:"key"`
+}
+
+// revokeKey revokes a key straight away, returning nil when there is no such
+// key or it is already revoked
+func revokeKey(db *sql.DB, keyID int) (*RevokedKey, error) {
+	var revoked RevokedKey
+	key := &revoked.Key
+	row := db.QueryRow(GenerateRevokeKeyQuery(), keyID)
+	switch err := row.Scan(&key.ID, &revoked.StoreID, &key.Prefix, &key.Label, &key.CreatedAt, &key.LastUsedAt, &key.ExpireAt, &key.RevokedAt); err {
+	case sql.ErrNoRows:
+		return nil, nil
+	case nil:
+	default:
+		return nil, err
+	}
+	log.Printf("Success: Revoked key [%s] of store [%s]", key.Prefix, revoked.StoreID)
+	return &revoked, nil
+}
+
+// Handler is our lambda handler invoked by the `lambda.Start` function call.
+// POST /admin/stores onboards a store, POST /admin/stores/keys issues a key to
+// a store and DELETE /admin/stores/keys revokes one
+func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (Response, error) {
+
+	if !authorized(request.Headers) {
+		log.Printf("Error: Request not authorized as admin")
+		return Response{StatusCode: 401,
+			Headers: map[string]string{
+				"Access-Control-Allow-Origin":      "*",
+				"Access-Control-Allow-Credentials": "true",
+			},
+		}, nil
+	}
+
+	issuingKey := request.HTTPMethod == "POST" && strings.HasSuffix(request.Path, "/keys")
+	revokingKey := request.HTTPMethod == "DELETE" && strings.HasSuffix(request.Path, "/keys")
+	if request.HTTPMethod == "POST" || revokingKey {
+
+		// A store, key or key id the admin got wrong is refused with a 400
+		// here, rather than surfacing as a constraint error from the insert
+		var store StoreRequest
+		var key KeyRequest
+		var keyID int
+		var resp *Response
+		switch {
+		case issuingKey:
+			if key, resp = parseKey(request.Body); resp != nil {
+				return *resp, nil
+			}
+			log.Printf("Info: Request key for store %s", key.StoreID)
+		case revokingKey:
+			var err error
+			if keyID, err = strconv.Atoi(request.QueryStringParameters["id"]); err != nil || keyID < 1 {
+				return errorResponse(400, "INVALID_REQUEST", "A key id is required"), nil
+			}
+			log.Printf("Info: Request revoking key %d", keyID)
+		default:
+			if store, resp = parseStore(request.Body); resp != nil {
+				return *resp, nil
+			}
+			log.Printf("Info: Request name %s", store.Name)
+			log.Printf("Info: Request postal code %s", store.PostalCode)
+		}
+
+		// Connect to database
+		connStr := fmt.Sprintf("host=%s user=%s password=%s dbname=%s sslmode=disable",
+			os.Getenv("DB_HOST"), os.Getenv("DB_USER"), os.Getenv("DB_PASSWORD"), os.Getenv("DB_NAME"))
+
+		db, err := sql.Open("postgres", connStr)
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		defer db.Close()
+
+		var result interface{}
+		if revokingKey {
+			var revoked *RevokedKey
+			if revoked, err = revokeKey(db, keyID); revoked != nil {
+				result = revoked
+			}
+		} else {
+			// The store and its key are created together, or not at all
+			var tx *sql.Tx
+			if tx, err = db.BeginTx(ctx, nil); err == nil {
+				var issued *IssuedKey
+				if issuingKey {
+					if issued, err = issueKey(tx, key); issued != nil {
+						result = issued
+					}
+				} else {
+					result, err = createStore(tx, store)
+				}
+
+				if err == nil && result != nil {
+					err = tx.Commit()
+				} else {
+					tx.Rollback()
+				}
+			}
+		}
+
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		if result == nil && revokingKey {
+			log.Printf("Error: Key [%d] NOT FOUND", keyID)
+			return errorResponse(404, "NOT_FOUND", "Key not found or already revoked"), nil
+		}
+		if result == nil {
+			log.Printf("Error: Store [%s] NOT FOUND", key.StoreID)
+			return errorResponse(404, "NOT_FOUND", "Store not found"), nil
+		}
+
+		//Generate message that want to be sent as body
+		message, err := json.Marshal(result)
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		//Returning response with AWS Lambda Proxy Response
+		return Response{StatusCode: 200,
+			Body: string(message),
+			Headers: map[string]string{
+				"Access-Control-Allow-Origin":      "*",
+				"Access-Control-Allow-Credentials": "true",
+				"Cache-Control":                    "no-store",
+			},
+		}, nil
+	}
+
+	// Missing one of required parameters
+	log.Printf("Error: Request missing a required parameter")
+	return Response{StatusCode: 400,
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin":      "*",
+			"Access-Control-Allow-Credentials": "true",
+		},
+	}, nil
+}
+
+type LocalServer struct{}
+
+func (l *LocalServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("Error reading request body: %v", err)
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("Failed to write body: %v", err)))
+		return
+	}
+
+	url, err := url.Parse(r.URL.String())
+	if err != nil {
+		log.Printf("Error parsing query string: %v", err)
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("Malformed query string: %v", err)))
+		return
+	}
+	queryParams := url.Query()
+
+	//**building request**
+	req := events.APIGatewayProxyRequest{
+		Body:                  string(body),
+		Headers:               make(map[string]string),
+		HTTPMethod:            r.Method,
+		Path:                  r.URL.Path,
+		QueryStringParameters: make(map[string]string),
+	}
+
+	//map raw request headers
+	for k, v := range r.Header {
+		req.Headers[strings.ToLower(k)] = v[0]
+	}
+
+	//Map raw query params
+	for k, v := range queryParams {
+		req.QueryStringParameters[strings.ToLower(k)] = v[0]
+	}
+
+	resp, err := Handler(r.Context(), req)
+	if err != nil {
+		log.Printf("Error handling request: %v", err)
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("Error handling request: %v", err)))
+		return
+	}
+	for k, v := range resp.Headers {
+		w.Header().Add(k, v)
+	}
+	(w).Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(resp.StatusCode)
+	w.Write([]byte(resp.Body))
+}
+
+func local() {
+	server := &LocalServer{}
+	fmt.Println("Starting local dev server on :8080")
+	http.ListenAndServe(":8080", server)
+}
+
+func main() {
+	if os.Getenv("AWS_LAMBDA_FUNCTION_NAME") == "" {
+		//see local creds file for env vars
+		local()
+	} else {
+		// Make the handler available for Remote Procedure Call by AWS Lambda
+		lambda.Start(Handler)
+	}
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/addauda/bubble-rewards-storefront-api/apikey"
+	"github.com/addauda/bubble-rewards-storefront-api/coupon"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	_ "github.com/lib/pq"
+)
+
+// Response is of type APIGatewayProxyResponse since we're leveraging the
+// AWS Lambda Proxy Request functionality (default behavior)
+//
+// https://serverless.com/framework/docs/providers/aws/events/apigateway/#lambda-proxy-integration
+type Response events.APIGatewayProxyResponse
+
+const expiration = time.Hour
+
+// defaultLimit and maxLimit bound how many submissions a page holds
+const (
+	defaultLimit = 50
+	maxLimit     = 200
+)
+
+var client = &http.Client{}
+
+// Submission is a submission awaiting moderation
+type Submission struct {
+	ID               string    `json:"id"`
+	InstagramAccount string    `json:"instagramAccount"`
+	FollowerCount    int       `json:"followerCount"`
+	OfferID          string    `json:"offerId"`
+	OfferDescription string    `json:"offerDescription"`
+	Status           string    `json:"status"`
+	CreatedAt        time.Time `json:"createdAt"`
+}
+
+// Submissions is a page of the moderation queue, oldest first
+type Submissions struct {
+	Submissions []Submission `json:"submissions"`
+	NextAfter   string       `json:"nextAfter,omitempty"`
+}
+
+// DecisionRequest is the body of a moderation decision
+type DecisionRequest struct {
+	ID        json.Number `json:"id"`
+	Decision  string      `json:"decision"`
+	Reason    string      `json:"reason"`
+	DecidedBy string      `json:"decided_by"`
+}
+
+// Decision is the outcome of moderating a submission
+type Decision struct {
+	SubmissionID string    `json:"submissionId"`
+	Status       string    `json:"status"`
+	Reason       string    `json:"reason,omitempty"`
+	DecidedBy    string    `json:"decidedBy"`
+	DecidedAt    time.Time `json:"decidedAt"`
+
+	// InstantRewardExpireAt is when the instant reward of an accepted
+	// submission stops being redeemable
+	InstantRewardExpireAt *time.Time `json:"instantRewardExpireAt,omitempty"`
+
+	// Coupon is the loyalty coupon issued on acceptance
+	Coupon *coupon.Coupon `json:"coupon,omitempty"`
+}
+
+// Refusal explains why a decision was refused
+type Refusal struct {
+	StatusCode int    `json:"-"`
+	Code       string `json:"error"`
+	Message    string `json:"message"`
+}
+
+// GeneratePendingSubmissionsQuery lists the submissions to a store's offers
+// awaiting moderation, oldest first, after a given submission id
+func GeneratePendingSubmissionsQuery() string {
+	return "SELECT submissions.id, submissions.instagram_account, submissions.follower_count, offers.id, actions.description, submissions.status, submissions.created_at from submissions join offers on submissions.offer_id = offers.id join actions on offers.action_id = actions.id WHERE offers.store_id = $1 AND submissions.status = 'PENDING' AND ($2::integer IS NULL OR offers.id = $2) AND submissions.id > $3 ORDER BY submissions.id LIMIT $4"
+}
+
+// GenerateLockSubmissionQuery reads a submission's status and owning store,
+// locking the submission row
+func GenerateLockSubmissionQuery() string {
+	return "SELECT submissions.status, offers.store_id from submissions join offers on submissions.offer_id = offers.id WHERE submissions.id = $1 FOR UPDATE OF submissions"
+}
+
+// GenerateDecideSubmissionQuery records a moderation decision and the API key
+// it was made with. The tier and rewards the submission earns are saved with
+// it, so that later changes to the offer or its tiers leave them alone.
+// Accepting starts the instant reward's validity afresh, as the submission
+// may have waited in the queue past its original expiry
+func GenerateDecideSubmissionQuery() string {
+	return "UPDATE submissions SET status = $2::status, decision_reason = $3, decided_by = $4, api_key_id = $5, decided_at = now(), updated_at = now(), instant_reward_expire_at = CASE WHEN $2::status = 'ACCEPTED' THEN now() + offers.instant_reward_validity ELSE submissions.instant_reward_expire_at END, tier_name = submission_rewards.tier_name, instant_reward_id = submission_rewards.instant_reward_id, loyalty_reward_id = submission_rewards.loyalty_reward_id FROM offers, submission_rewards WHERE submissions.offer_id = offers.id AND submission_rewards.submission_id = submissions.id AND submissions.id = $1 AND submissions.status = 'PENDING' RETURNING submissions.decided_at, submissions.instant_reward_expire_at"
+}
+
+// GenerateSubmissionCouponQuery finds a coupon already issued for a
+// submission
+func GenerateSubmissionCouponQuery() string {
+	return "SELECT id, code, expire_at, max_uses from redemptions_coupon WHERE submission_id = $1 ORDER BY id LIMIT 1"
+}
+
+// listPending reads a page of the moderation queue, fetching one extra
+// submission to tell whether there is a next page
+func listPending(db *sql.DB, storeID int, offerID sql.NullInt64, after int, limit int) (Submissions, error) {
+	page := Submissions{Submissions: []Submission{}}
+	rows, err := db.Query(GeneratePendingSubmissionsQuery(), storeID, offerID, after, limit+1)
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if len(page.Submissions) == limit {
+			page.NextAfter = page.Submissions[limit-1].ID
+			break
+		}
+		var submission Submission
+		if err = rows.Scan(&submission.ID, &submission.InstagramAccount, &submission.FollowerCount, &submission.OfferID, &submission.OfferDescription, &submission.Status, &submission.CreatedAt); err != nil {
+			return page, err
+		}
+		page.Submissions = append(page.Submissions, submission)
+	}
+	return page, rows.Err()
+}
+
+// decide locks the submission, checks that the calling store may moderate it
+// and records the decision, all within tx
+func decide(tx *sql.Tx, caller apikey.Caller, body DecisionRequest) (Decision, *Refusal, error) {
+	decision := Decision{SubmissionID: body.ID.String(), Status: body.Decision, Reason: body.Reason, DecidedBy: body.DecidedBy}
+
+	var status string
+	var ownerID int
+	row := tx.QueryRow(GenerateLockSubmissionQuery(), decision.SubmissionID)
+	switch err := row.Scan(&status, &ownerID); err {
+	case sql.ErrNoRows:
+		return decision, &Refusal{StatusCode: 404, Code: "NOT_FOUND", Message: "Submission not found"}, nil
+	case nil:
+	default:
+		return decision, nil, err
+	}
+
+	switch {
+	case ownerID != caller.StoreID:
+		return decision, &Refusal{StatusCode: 403, Code: "WRONG_STORE", Message: "Submission belongs to another store"}, nil
+	case status != "PENDING":
+		return decision, &Refusal{StatusCode: 409, Code: "ALREADY_DECIDED", Message: fmt.Sprintf("Submission is already %s", status)}, nil
+	}
+
+	row = tx.QueryRow(GenerateDecideSubmissionQuery(), decision.SubmissionID, decision.Status, sql.NullString{String: body.Reason, Valid: body.Reason != ""}, body.DecidedBy, caller.KeyID)
+	var instantRewardExpireAt time.Time
+	if err := row.Scan(&decision.DecidedAt, &instantRewardExpireAt); err != nil {
+		return decision, nil, err
+	}
+	log.Printf("Success: Submission [%s] %s by [%s] with key [%d]", decision.SubmissionID, decision.Status, decision.DecidedBy, caller.KeyID)
+
+	if decision.Status == "ACCEPTED" {
+		decision.InstantRewardExpireAt = &instantRewardExpireAt
+		issued, err := issueCoupon(tx, decision.SubmissionID)
+		if err != nil {
+			return decision, nil, err
+		}
+		decision.Coupon = &issued
+	}
+	return decision, nil, nil
+}
+
+// issueCoupon issues the loyalty coupon for an accepted submission. The
+// submission was locked while PENDING, so this runs once per submission; a
+// coupon issued by hand beforehand is returned rather than doubled up
+func issueCoupon(tx *sql.Tx, id string) (coupon.Coupon, error) {
+	var issued coupon.Coupon
+	switch err := tx.QueryRow(GenerateSubmissionCouponQuery(), id).Scan(&issued.ID, &issued.Code, &issued.ExpireAt, &issued.MaxUses); err {
+	case sql.ErrNoRows:
+	case nil:
+		log.Printf("Info: Submission [%s] already has coupon [%d]", id, issued.ID)
+		return issued, nil
+	default:
+		return issued, err
+	}
+
+	submissionID, err := strconv.Atoi(id)
+	if err != nil {
+		return issued, err
+	}
+	if issued, err = coupon.Issue(tx, submissionID); err != nil {
+		return issued, err
+	}
+	log.Printf("Success: Issued coupon [%d] for submission [%s]", issued.ID, id)
+	return issued, nil
+}
+
+// parseDecision reads a decision. Rejections need a reason, as it is what
+// the customer is told
+func parseDecision(body string) (DecisionRequest, *Refusal) {
+	var decision DecisionRequest
+	if err := json.Unmarshal([]byte(body), &decision); err != nil {
+		log.Printf("Error: Malformed request body: %v", err)
+		return decision, &Refusal{StatusCode: 400, Code: "INVALID_REQUEST", Message: "Malformed request body"}
+	}
+	if _, err := decision.ID.Int64(); err != nil || decision.DecidedBy == "" {
+		return decision, &Refusal{StatusCode: 400, Code: "INVALID_REQUEST", Message: "A submission id and decided_by are required"}
+	}
+	switch decision.Decision {
+	case "ACCEPTED":
+	case "REJECTED":
+		if decision.Reason == "" {
+			return decision, &Refusal{StatusCode: 400, Code: "REASON_REQUIRED", Message: "Rejections need a reason"}
+		}
+	default:
+		return decision, &Refusal{StatusCode: 400, Code: "INVALID_DECISION", Message: "Decision must be ACCEPTED or REJECTED"}
+	}
+	return decision, nil
+}
+
+// refusalResponse builds an error response with a machine readable error code
+func refusalResponse(refusal *Refusal) (Response, error) {
+	body, err := json.Marshal(refusal)
+	if err != nil {
+		return Response{}, err
+	}
+	return Response{StatusCode: refusal.StatusCode,
+		Body: string(body),
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin":      "*",
+			"Access-Control-Allow-Credentials": "true",
+		},
+	}, nil
+}
+
+// Handler is our lambda handler invoked by the `lambda.Start` function call.
+// GET lists the moderation queue and POST decides on a submission
+func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (Response, error) {
+
+	apiKey := request.QueryStringParameters["api_key"]
+
+	// Ensure all fields are not empty
+	if apiKey != "" && (request.HTTPMethod == "GET" || request.HTTPMethod == "POST") {
+
+		log.Printf("Info: Request method %s", request.HTTPMethod)
+		log.Printf("Info: Request API key %s", apikey.Visible(apiKey))
+
+		// Bad paging parameters would otherwise fail the queue query as a 500
+		var body DecisionRequest
+		var offerID sql.NullInt64
+		after := 0
+		limit := defaultLimit
+		if request.HTTPMethod == "POST" {
+			var refusal *Refusal
+			if body, refusal = parseDecision(request.Body); refusal != nil {
+				return refusalResponse(refusal)
+			}
+			log.Printf("Info: Request submission %s", body.ID)
+			log.Printf("Info: Request decision %s", body.Decision)
+			log.Printf("Info: Request decided by %s", body.DecidedBy)
+		} else {
+			var err error
+			if o := request.QueryStringParameters["offer_id"]; o != "" {
+				offerID.Valid = true
+				if offerID.Int64, err = strconv.ParseInt(o, 10, 32); err != nil {
+					return refusalResponse(&Refusal{StatusCode: 400, Code: "INVALID_REQUEST", Message: "Invalid offer_id"})
+				}
+			}
+			if a := request.QueryStringParameters["after"]; a != "" {
+				if after, err = strconv.Atoi(a); err != nil {
+					return refusalResponse(&Refusal{StatusCode: 400, Code: "INVALID_REQUEST", Message: "Invalid after"})
+				}
+			}
+			if l := request.QueryStringParameters["limit"]; l != "" {
+				if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > maxLimit {
+					return refusalResponse(&Refusal{StatusCode: 400, Code: "INVALID_REQUEST", Message: fmt.Sprintf("limit must be between 1 and %d", maxLimit)})
+				}
+			}
+		}
+
+		// Connect to database
+		connStr := fmt.Sprintf("host=%s user=%s password=%s dbname=%s sslmode=disable",
+			os.Getenv("DB_HOST"), os.Getenv("DB_USER"), os.Getenv("DB_PASSWORD"), os.Getenv("DB_NAME"))
+
+		db, err := sql.Open("postgres", connStr)
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		defer db.Close()
+
+		// Validate API key, remembering which key decisions are made with
+		caller, err := apikey.Identify(db, apiKey)
+		switch err {
+		case apikey.ErrInvalid:
+			log.Printf("Error: No store with API key [%s] was found", apikey.Visible(apiKey))
+			return Response{StatusCode: 401,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		case nil:
+			log.Printf("Info: Retreived store as [%s]", caller.StoreName)
+		default:
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		var result interface{}
+		if request.HTTPMethod == "GET" {
+			result, err = listPending(db, caller.StoreID, offerID, after, limit)
+		} else {
+			// Check and decide within one transaction so two moderators
+			// cannot both decide the same submission
+			var tx *sql.Tx
+			if tx, err = db.BeginTx(ctx, nil); err == nil {
+				var refusal *Refusal
+				result, refusal, err = decide(tx, caller, body)
+				if err == nil && refusal == nil {
+					err = tx.Commit()
+				} else {
+					tx.Rollback()
+				}
+				if err == nil && refusal != nil {
+					log.Printf("Error: Decision on [%s] refused as [%s]", body.ID, refusal.Code)
+					return refusalResponse(refusal)
+				}
+			}
+		}
+
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		//Generate message that want to be sent as body
+		message, err := json.Marshal(result)
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		//Returning response with AWS Lambda Proxy Response
+		return Response{StatusCode: 200,
+			Body: string(message),
+			Headers: map[string]string{
+				"Access-Control-Allow-Origin":      "*",
+				"Access-Control-Allow-Credentials": "true",
+			},
+		}, nil
+	}
+
+	// Missing one of required parameters
+	log.Printf("Error: Request missing a required parameter")
+	return Response{StatusCode: 400,
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin":      "*",
+			"Access-Control-Allow-Credentials": "true",
+		},
+	}, nil
+}
+
+type LocalServer struct{}
+
+func (l *LocalServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("Error reading request body: %v", err)
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("Failed to write body: %v", err)))
+		return
+	}
+
+	url, err := url.Parse(r.URL.String())
+	if err != nil {
+		log.Printf("Error parsing query string: %v", err)
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("Malformed query string: %v", err)))
+		return
+	}
+	queryParams := url.Query()
+
+	//**building request**
+	req := events.APIGatewayProxyRequest{
+		Body:                  string(body),
+		Headers:               make(map[string]string),
+		HTTPMethod:            r.Method,
+		Path:                  r.URL.Path,
+		QueryStringParameters: make(map[string]string),
+	}
+
+	//map raw request headers
+	for k, v := range r.Header {
+		req.Headers[strings.ToLower(k)] = v[0]
+	}
+
+	//Map raw query params
+	for k, v := range queryParams {
+		req.QueryStringParameters[strings.ToLower(k)] = v[0]
+	}
+
+	resp, err := Handler(r.Context(), req)
+	if err != nil {
+		log.Printf("Error handling request: %v", err)
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("Error handling request: %v", err)))
+		return
+	}
+	for k, v := range resp.Headers {
+		w.Header().Add(k, v)
+	}
+	(w).Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(resp.StatusCode)
+	w.Write([]byte(resp.Body))
+}
+
+func local() {
+	server := &LocalServer{}
+	fmt.Println("Starting local dev server on :8080")
+	http.ListenAndServe(":8080", server)
+}
+
+func main() {
+	if os.Getenv("AWS_LAMBDA_FUNCTION_NAME") == "" {
+		//see local creds file for env vars
+		local()
+	} else {
+		// Make the handler available for Remote Procedure Call by AWS Lambda
+		lambda.Start(Handler)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	_ "github.com/lib/pq"
+)
+
+// defaultBatchSize applies when SWEEP_BATCH_SIZE is not set
+const defaultBatchSize = 500
+
+// defaultGrace applies when SWEEP_GRACE_HOURS is not set. It matches how long
+// a POS may hold offline redemptions, which are applied as of when they were
+// made and so may still land on something past its expiry
+const defaultGrace = 7 * 24 * time.Hour
+
+// Sweep reports what a run of the sweeper expired
+type Sweep struct {
+	ID                 int       `json:"id"`
+	StartedAt          time.Time `json:"startedAt"`
+	CouponsExpired     int       `json:"couponsExpired"`
+	SubmissionsExpired int       `json:"submissionsExpired"`
+}
+
+// GenerateStartSweepQuery records the start of a sweep
+func GenerateStartSweepQuery() string {
+	return "INSERT INTO expiry_sweeps DEFAULT VALUES RETURNING id, started_at"
+}
+
+// GenerateFinishSweepQuery records the outcome of a sweep
+func GenerateFinishSweepQuery() string {
+	return "UPDATE expiry_sweeps SET coupons_expired = $2, submissions_expired = $3, finished_at = now() WHERE id = $1"
+}
+
+// GenerateExpireCouponsQuery expires a batch of pending coupons past their
+// expiry and the grace period, logging each. Rows locked by a concurrent
+// redemption or sweep are skipped, and picked up by a later batch or run
+func GenerateExpireCouponsQuery() string {
+	return "WITH stale AS (SELECT id from redemptions_coupon WHERE status = 'PENDING' AND expire_at <= current_timestamp - $2::interval ORDER BY id LIMIT $3 FOR UPDATE SKIP LOCKED), " +
+		"expired AS (UPDATE redemptions_coupon SET status = 'EXPIRED' FROM stale WHERE redemptions_coupon.id = stale.id RETURNING redemptions_coupon.id, redemptions_coupon.expire_at) " +
+		"INSERT INTO expired_redemptions (sweep_id, redemption_type, redemption_id, expire_at) SELECT $1, 'COUPON', id, expire_at from expired"
+}
+
+// GenerateExpireSubmissionsQuery expires a batch of accepted submissions whose
+// instant reward was never redeemed, in the same way as coupons
+func GenerateExpireSubmissionsQuery() string {
+	return "WITH stale AS (SELECT id from submissions WHERE status = 'ACCEPTED' AND instant_reward_expire_at <= current_timestamp - $2::interval AND NOT EXISTS (SELECT 1 from redemptions_instant WHERE redemptions_instant.submission_id = submissions.id) ORDER BY id LIMIT $3 FOR UPDATE SKIP LOCKED), " +
+		"expired AS (UPDATE submissions SET status = 'EXPIRED', updated_at = now() FROM stale WHERE submissions.id = stale.id RETURNING submissions.id, submissions.instant_reward_expire_at) " +
+		"INSERT INTO expired_redemptions (sweep_id, redemption_type, redemption_id, expire_at) SELECT $1, 'INSTANT', id, instant_reward_expire_at from expired"
+}
+
+// settings reads the batch size and grace period from the environment
+func settings() (int, time.Duration) {
+	batchSize := defaultBatchSize
+	if s := os.Getenv("SWEEP_BATCH_SIZE"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			batchSize = n
+		} else {
+			log.Printf("Error: Invalid SWEEP_BATCH_SIZE [%s], using %d", s, defaultBatchSize)
+		}
+	}
+
+	grace := defaultGrace
+	if s := os.Getenv("SWEEP_GRACE_HOURS"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+			grace = time.Duration(n) * time.Hour
+		} else {
+			log.Printf("Error: Invalid SWEEP_GRACE_HOURS [%s], using %v", s, defaultGrace)
+		}
+	}
+	return batchSize, grace
+}
+
+// expireInBatches runs an expiry query until a batch comes back short. Each
+// batch commits on its own so locks are held briefly
+func expireInBatches(ctx context.Context, db *sql.DB, query string, sweepID int, grace time.Duration, batchSize int) (int, error) {
+	total := 0
+	interval := fmt.Sprintf("%d seconds", int64(grace/time.Second))
+	for {
+		result, err := db.ExecContext(ctx, query, sweepID, interval, batchSize)
+		if err != nil {
+			return total, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += int(n)
+		if int(n) < batchSize {
+			return total, nil
+		}
+	}
+}
+
+// sweep expires stale coupons and submissions and records the run
+func sweep(ctx context.Context, db *sql.DB) (Sweep, error) {
+	batchSize, grace := settings()
+
+	var run Sweep
+	if err := db.QueryRowContext(ctx, GenerateStartSweepQuery()).Scan(&run.ID, &run.StartedAt); err != nil {
+		return run, err
+	}
+	log.Printf("Info: Sweep [%d] started with batches of %d and %v grace", run.ID, batchSize, grace)
+
+	var err error
+	if run.CouponsExpired, err = expireInBatches(ctx, db, GenerateExpireCouponsQuery(), run.ID, grace, batchSize); err != nil {
+		return run, err
+	}
+	log.Printf("Info: Sweep [%d] expired %d coupons", run.ID, run.CouponsExpired)
+
+	if run.SubmissionsExpired, err = expireInBatches(ctx, db, GenerateExpireSubmissionsQuery(), run.ID, grace, batchSize); err != nil {
+		return run, err
+	}
+	log.Printf("Info: Sweep [%d] expired %d submissions", run.ID, run.SubmissionsExpired)
+
+	_, err = db.ExecContext(ctx, GenerateFinishSweepQuery(), run.ID, run.CouponsExpired, run.SubmissionsExpired)
+	return run, err
+}
+
+// Handler is our lambda handler invoked on a schedule by the `lambda.Start`
+// function call
+func Handler(ctx context.Context, event events.CloudWatchEvent) (Sweep, error) {
+
+	// Connect to database
+	connStr := fmt.Sprintf("host=%s user=%s password=%s dbname=%s sslmode=disable",
+		os.Getenv("DB_HOST"), os.Getenv("DB_USER"), os.Getenv("DB_PASSWORD"), os.Getenv("DB_NAME"))
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		log.Printf("Error: %v", err)
+		return Sweep{}, err
+	}
+
+	defer db.Close()
+
+	run, err := sweep(ctx, db)
+	if err != nil {
+		log.Printf("Error: Sweep [%d] failed: %v", run.ID, err)
+		return run, err
+	}
+	log.Printf("Success: Sweep [%d] finished", run.ID)
+	return run, nil
+}
+
+// local runs a single sweep and prints its outcome
+func local() {
+	run, err := Handler(context.Background(), events.CloudWatchEvent{})
+	if err != nil {
+		os.Exit(1)
+	}
+	out, _ := json.Marshal(run)
+	fmt.Println(string(out))
+}
+
+func main() {
+	if os.Getenv("AWS_LAMBDA_FUNCTION_NAME") == "" {
+		//see local creds file for env vars
+		local()
+	} else {
+		// Make the handler available for Remote Procedure Call by AWS Lambda
+		lambda.Start(Handler)
+	}
+}
@@ -0,0 +1,122 @@
+package token
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strings"
+	"time"
+)
+
+// MaxLifetime caps how long a token stays valid, whatever the coupon's own
+// expiry. A retired key must stay among the verify keys for this long after
+// it stops signing
+const MaxLifetime = 30 * 24 * time.Hour
+
+// ErrNoKeys is returned when no signing or verify keys are configured
+var ErrNoKeys = errors.New("token: no signing keys configured")
+
+// Keyring holds every key tokens may be verified with and the one new
+// tokens are signed with
+type Keyring struct {
+	ActiveKeyID string
+	private     map[string]ed25519.PrivateKey
+}
+
+// ParseKeyring reads a comma separated list of {key id}:{base64 seed} pairs,
+// each seed being a 32 byte Ed25519 seed. New tokens are signed with
+// activeKeyID, which defaults to the last key listed
+func ParseKeyring(signingKeys string, activeKeyID string) (*Keyring, error) {
+	k := &Keyring{private: make(map[string]ed25519.PrivateKey)}
+	for _, pair := range strings.Split(signingKeys, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || strings.Contains(parts[0], ".") {
+			return nil, ErrMalformed
+		}
+		seed, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, ErrMalformed
+		}
+		k.private[parts[0]] = ed25519.NewKeyFromSeed(seed)
+		k.ActiveKeyID = parts[0]
+	}
+
+	if len(k.private) == 0 {
+		return nil, ErrNoKeys
+	}
+	if activeKeyID != "" {
+		if _, ok := k.private[activeKeyID]; !ok {
+			return nil, ErrUnknownKey
+		}
+		k.ActiveKeyID = activeKeyID
+	}
+	return k, nil
+}
+
+// KeyringFromEnv reads the keyring from TOKEN_SIGNING_KEYS and
+// TOKEN_ACTIVE_KEY_ID
+func KeyringFromEnv() (*Keyring, error) {
+	return ParseKeyring(os.Getenv("TOKEN_SIGNING_KEYS"), os.Getenv("TOKEN_ACTIVE_KEY_ID"))
+}
+
+// ParseVerifyKeys reads a comma separated list of {key id}:{base64 public
+// key} pairs, each key being a 32 byte Ed25519 public key. Functions that
+// only verify tokens are given these rather than the signing keys, and a
+// retired key stays here until its tokens have expired
+func ParseVerifyKeys(verifyKeys string) (map[string]ed25519.PublicKey, error) {
+	keys := make(map[string]ed25519.PublicKey)
+	for _, pair := range strings.Split(verifyKeys, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || strings.Contains(parts[0], ".") {
+			return nil, ErrMalformed
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, ErrMalformed
+		}
+		keys[parts[0]] = ed25519.PublicKey(key)
+	}
+
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+	return keys, nil
+}
+
+// VerifyKeysFromEnv reads the verify keys from TOKEN_VERIFY_KEYS
+func VerifyKeysFromEnv() (map[string]ed25519.PublicKey, error) {
+	return ParseVerifyKeys(os.Getenv("TOKEN_VERIFY_KEYS"))
+}
+
+// Issue signs a token for the coupon with the active key. The token expires
+// with the coupon or after MaxLifetime, whichever comes first
+func (k *Keyring) Issue(couponID int, storeID int, expireAt time.Time) (string, error) {
+	if latest := time.Now().Add(MaxLifetime); expireAt.After(latest) {
+		expireAt = latest
+	}
+	return Sign(k.ActiveKeyID, k.private[k.ActiveKeyID], Claims{CouponID: couponID, StoreID: storeID, ExpireAt: expireAt})
+}
+
+// PublicKeys returns the keys tokens may be verified with by key id, which
+// is what a POS needs to verify tokens offline
+func (k *Keyring) PublicKeys() map[string]ed25519.PublicKey {
+	keys := make(map[string]ed25519.PublicKey, len(k.private))
+	for id, key := range k.private {
+		keys[id] = key.Public().(ed25519.PublicKey)
+	}
+	return keys
+}
+
+// Verify checks a token against every key in the keyring
+func (k *Keyring) Verify(payload string, now time.Time) (Claims, error) {
+	return Verify(payload, k.PublicKeys(), now)
+}
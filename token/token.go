@@ -0,0 +1,129 @@
+// Package token issues and verifies compact signed redemption tokens. A token
+// names a coupon, the store it belongs to and when it expires, and is signed
+// with Ed25519 so that a POS holding only the public keys can verify it
+// without the network.
+//
+// A token reads BT.{key id}.{claims}.{signature} where claims and signature
+// are unpadded base64url. The key id picks the public key to verify with, so
+// keys can be rotated while tokens signed with older keys remain valid until
+// they expire.
+package token
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Prefix starts every token
+const Prefix = "BT."
+
+// claimsSize is the encoded size of Claims: coupon id, store id and expiry as
+// 32 bit unsigned integers followed by the nonce
+const claimsSize = 4 + 4 + 4 + 8
+
+var (
+	// ErrMalformed is returned for strings that do not parse as a token
+	ErrMalformed = errors.New("token: malformed")
+	// ErrUnknownKey is returned when the token names a key that is not known
+	ErrUnknownKey = errors.New("token: unknown key id")
+	// ErrSignature is returned when the signature does not match the claims
+	ErrSignature = errors.New("token: invalid signature")
+	// ErrExpired is returned for tokens past their expiry
+	ErrExpired = errors.New("token: expired")
+)
+
+// Claims are the facts a token vouches for
+type Claims struct {
+	CouponID int
+	StoreID  int
+	ExpireAt time.Time
+	Nonce    [8]byte
+}
+
+// encode packs the claims into their binary form
+func (c Claims) encode() []byte {
+	b := make([]byte, claimsSize)
+	binary.BigEndian.PutUint32(b[0:], uint32(c.CouponID))
+	binary.BigEndian.PutUint32(b[4:], uint32(c.StoreID))
+	binary.BigEndian.PutUint32(b[8:], uint32(c.ExpireAt.Unix()))
+	copy(b[12:], c.Nonce[:])
+	return b
+}
+
+// decode unpacks claims from their binary form
+func decode(b []byte) (Claims, error) {
+	if len(b) != claimsSize {
+		return Claims{}, ErrMalformed
+	}
+	c := Claims{
+		CouponID: int(binary.BigEndian.Uint32(b[0:])),
+		StoreID:  int(binary.BigEndian.Uint32(b[4:])),
+		ExpireAt: time.Unix(int64(binary.BigEndian.Uint32(b[8:])), 0).UTC(),
+	}
+	copy(c.Nonce[:], b[12:])
+	return c, nil
+}
+
+// IsToken reports whether a scanned payload looks like a token
+func IsToken(payload string) bool {
+	return strings.HasPrefix(payload, Prefix)
+}
+
+// Sign issues a token for the claims with the given key, filling in a random
+// nonce
+func Sign(keyID string, key ed25519.PrivateKey, claims Claims) (string, error) {
+	if keyID == "" || strings.Contains(keyID, ".") {
+		return "", ErrUnknownKey
+	}
+	if _, err := rand.Read(claims.Nonce[:]); err != nil {
+		return "", err
+	}
+	signed := Prefix + keyID + "." + base64.RawURLEncoding.EncodeToString(claims.encode())
+	signature := ed25519.Sign(key, []byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Verify checks a token's signature against the public key it names and that
+// it has not expired at now, returning its claims
+func Verify(payload string, keys map[string]ed25519.PublicKey, now time.Time) (Claims, error) {
+	if !IsToken(payload) {
+		return Claims{}, ErrMalformed
+	}
+	parts := strings.Split(payload[len(Prefix):], ".")
+	if len(parts) != 3 {
+		return Claims{}, ErrMalformed
+	}
+
+	key, ok := keys[parts[0]]
+	if !ok {
+		return Claims{}, ErrUnknownKey
+	}
+
+	encoded, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return Claims{}, ErrMalformed
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Claims{}, ErrMalformed
+	}
+
+	signed := payload[:len(payload)-len(parts[2])-1]
+	if !ed25519.Verify(key, []byte(signed), signature) {
+		return Claims{}, ErrSignature
+	}
+
+	claims, err := decode(encoded)
+	if err != nil {
+		return Claims{}, err
+	}
+	if !now.Before(claims.ExpireAt) {
+		return claims, ErrExpired
+	}
+	return claims, nil
+}
@@ -0,0 +1,307 @@
+package token
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+// seed makes a base64 Ed25519 seed filled with b
+func seed(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), 32)))
+}
+
+func TestParseKeyring(t *testing.T) {
+	tests := []struct {
+		name        string
+		signingKeys string
+		activeKeyID string
+		wantActive  string
+		wantErr     error
+	}{
+		{"single key", "k1:" + seed(1), "", "k1", nil},
+		{"defaults to last key", "k1:" + seed(1) + ",k2:" + seed(2), "", "k2", nil},
+		{"explicit active key", "k1:" + seed(1) + ", k2:" + seed(2), "k1", "k1", nil},
+		{"blank entries skipped", " ,k1:" + seed(1) + ",", "", "k1", nil},
+		{"no keys", "", "", "", ErrNoKeys},
+		{"unknown active key", "k1:" + seed(1), "k3", "", ErrUnknownKey},
+		{"missing seed", "k1", "", "", ErrMalformed},
+		{"missing key id", ":" + seed(1), "", "", ErrMalformed},
+		{"dot in key id", "k.1:" + seed(1), "", "", ErrMalformed},
+		{"not base64", "k1:!!!", "", "", ErrMalformed},
+		{"short seed", "k1:" + base64.StdEncoding.EncodeToString([]byte("short")), "", "", ErrMalformed},
+	}
+
+	for _, tt := range tests {
+		k, err := ParseKeyring(tt.signingKeys, tt.activeKeyID)
+		if err != tt.wantErr {
+			t.Errorf("%s: ParseKeyring error = %v, want %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && k.ActiveKeyID != tt.wantActive {
+			t.Errorf("%s: ActiveKeyID = %q, want %q", tt.name, k.ActiveKeyID, tt.wantActive)
+		}
+	}
+}
+
+func TestParseVerifyKeys(t *testing.T) {
+	k, err := ParseKeyring("k1:"+seed(1)+",k2:"+seed(2), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := func(id string) string {
+		return base64.StdEncoding.EncodeToString(k.PublicKeys()[id])
+	}
+
+	tests := []struct {
+		name       string
+		verifyKeys string
+		wantIDs    []string
+		wantErr    error
+	}{
+		{"single key", "k1:" + public("k1"), []string{"k1"}, nil},
+		{"several keys", "k1:" + public("k1") + ", k2:" + public("k2"), []string{"k1", "k2"}, nil},
+		{"blank entries skipped", ",k2:" + public("k2") + ", ", []string{"k2"}, nil},
+		{"no keys", "", nil, ErrNoKeys},
+		{"missing key", "k1", nil, ErrMalformed},
+		{"missing key id", ":" + public("k1"), nil, ErrMalformed},
+		{"dot in key id", "k.1:" + public("k1"), nil, ErrMalformed},
+		{"not base64", "k1:!!!", nil, ErrMalformed},
+		{"short key", "k1:" + base64.StdEncoding.EncodeToString([]byte("short")), nil, ErrMalformed},
+		{"private key", "k1:" + base64.StdEncoding.EncodeToString(k.private["k1"]), nil, ErrMalformed},
+	}
+
+	for _, tt := range tests {
+		keys, err := ParseVerifyKeys(tt.verifyKeys)
+		if err != tt.wantErr {
+			t.Errorf("%s: ParseVerifyKeys error = %v, want %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if len(keys) != len(tt.wantIDs) {
+			t.Errorf("%s: got %d keys, want %d", tt.name, len(keys), len(tt.wantIDs))
+		}
+		for _, id := range tt.wantIDs {
+			if !keys[id].Equal(k.PublicKeys()[id]) {
+				t.Errorf("%s: key %q does not match the keyring's public key", tt.name, id)
+			}
+		}
+	}
+}
+
+func TestVerifyWithPublicKeysOnly(t *testing.T) {
+	signing, err := ParseKeyring("k2:"+seed(2), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	retired, err := ParseKeyring("k1:"+seed(1), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := ParseVerifyKeys("k1:" + base64.StdEncoding.EncodeToString(retired.PublicKeys()["k1"]) +
+		",k2:" + base64.StdEncoding.EncodeToString(signing.PublicKeys()["k2"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for _, k := range []*Keyring{signing, retired} {
+		payload, err := k.Issue(3, 4, now.Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, err := Verify(payload, keys, now)
+		if err != nil || claims.CouponID != 3 || claims.StoreID != 4 {
+			t.Errorf("Verify with %s's public key = %+v, %v, want coupon 3 of store 4", k.ActiveKeyID, claims, err)
+		}
+	}
+}
+
+func TestIssueAndVerify(t *testing.T) {
+	k, err := ParseKeyring("k1:"+seed(1), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	expireAt := now.Add(48 * time.Hour).Truncate(time.Second)
+
+	payload, err := k.Issue(42, 7, expireAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsToken(payload) || !strings.HasPrefix(payload, Prefix+"k1.") {
+		t.Fatalf("Issue = %q, want a token signed with k1", payload)
+	}
+
+	claims, err := k.Verify(payload, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.CouponID != 42 || claims.StoreID != 7 || !claims.ExpireAt.Equal(expireAt) {
+		t.Errorf("Verify = %+v, want coupon 42, store 7, expiring %v", claims, expireAt)
+	}
+
+	again, err := k.Issue(42, 7, expireAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == payload {
+		t.Error("Issue gave the same token twice, want a fresh nonce each time")
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	k, err := ParseKeyring("k1:"+seed(1), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Truncate(time.Second)
+	expireAt := now.Add(time.Hour)
+	payload, err := k.Issue(1, 1, expireAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		at      time.Time
+		wantErr error
+	}{
+		{"well before expiry", now, nil},
+		{"a second before expiry", expireAt.Add(-time.Second), nil},
+		{"at expiry", expireAt, ErrExpired},
+		{"after expiry", expireAt.Add(time.Second), ErrExpired},
+	}
+
+	for _, tt := range tests {
+		if _, err := k.Verify(payload, tt.at); err != tt.wantErr {
+			t.Errorf("%s: Verify error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestIssueCapsLifetime(t *testing.T) {
+	k, err := ParseKeyring("k1:"+seed(1), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		expireAt time.Time
+		capped   bool
+	}{
+		{"within the lifetime", time.Now().Add(MaxLifetime / 2), false},
+		{"past the lifetime", time.Now().Add(2 * MaxLifetime), true},
+		{"far future", time.Now().AddDate(5, 0, 0), true},
+	}
+
+	for _, tt := range tests {
+		before := time.Now()
+		payload, err := k.Issue(1, 1, tt.expireAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, err := k.Verify(payload, before)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		want := tt.expireAt
+		if tt.capped {
+			want = before.Add(MaxLifetime)
+		}
+		if d := claims.ExpireAt.Sub(want); d < -2*time.Second || d > 2*time.Second {
+			t.Errorf("%s: token expires %v, want about %v", tt.name, claims.ExpireAt, want)
+		}
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	old, err := ParseKeyring("k1:"+seed(1), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	payload, err := old.Issue(1, 1, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		signingKeys string
+		activeKeyID string
+		wantErr     error
+	}{
+		{"new key added but not active", "k1:" + seed(1) + ",k2:" + seed(2), "k1", nil},
+		{"new key active, old key kept", "k1:" + seed(1) + ",k2:" + seed(2), "", nil},
+		{"old key retired", "k2:" + seed(2), "", ErrUnknownKey},
+		{"old key id reused for another key", "k1:" + seed(3), "", ErrSignature},
+	}
+
+	for _, tt := range tests {
+		k, err := ParseKeyring(tt.signingKeys, tt.activeKeyID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := k.Verify(payload, now); err != tt.wantErr {
+			t.Errorf("%s: Verify error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	rotated, err := ParseKeyring("k1:"+seed(1)+",k2:"+seed(2), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err = rotated.Issue(1, 1, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(payload, Prefix+"k2.") {
+		t.Errorf("Issue after rotation = %q, want it signed with k2", payload)
+	}
+	if _, err := old.Verify(payload, now); err != ErrUnknownKey {
+		t.Errorf("Verify with a keyring lacking k2 error = %v, want %v", err, ErrUnknownKey)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	k, err := ParseKeyring("k1:"+seed(1), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	payload, err := k.Issue(1, 1, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(payload, ".")
+	other, err := k.Issue(2, 1, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherParts := strings.Split(other, ".")
+
+	tests := []struct {
+		name    string
+		payload string
+		wantErr error
+	}{
+		{"coupon code", "ABCDEJ", ErrMalformed},
+		{"legacy payload", "BUBBLE:ABCDEJ", ErrMalformed},
+		{"too few parts", "BT.k1.claims", ErrMalformed},
+		{"too many parts", payload + ".extra", ErrMalformed},
+		{"unknown key", "BT.k9." + parts[2] + "." + parts[3], ErrUnknownKey},
+		{"claims not base64", "BT.k1.!!!." + parts[3], ErrMalformed},
+		{"signature not base64", "BT.k1." + parts[2] + ".!!!", ErrMalformed},
+		{"claims swapped", "BT.k1." + otherParts[2] + "." + parts[3], ErrSignature},
+		{"signature swapped", "BT.k1." + parts[2] + "." + otherParts[3], ErrSignature},
+	}
+
+	for _, tt := range tests {
+		if _, err := k.Verify(tt.payload, now); err != tt.wantErr {
+			t.Errorf("%s: Verify error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -3,15 +3,21 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/addauda/bubble-rewards-storefront-api/apikey"
+	"github.com/addauda/bubble-rewards-storefront-api/coupon"
+	"github.com/addauda/bubble-rewards-storefront-api/handle"
+	"github.com/addauda/bubble-rewards-storefront-api/token"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	_ "github.com/lib/pq"
@@ -28,11 +34,194 @@ const expiration = time.Hour
 var client = &http.Client{}
 
 func GenerateCouponCodeQuery() string {
-	return "SELECT redemptions_coupon.id, submissions.instagram_account, rewards.description, redemptions_coupon.status from public.redemptions_coupon join submissions on redemptions_coupon.submission_id = submissions.id join offers on submissions.offer_id = offers.id join rewards on offers.loyalty_reward_id = rewards.id WHERE code = $1 AND redemptions_coupon.status = 'PENDING' AND current_timestamp < redemptions_coupon.expire_at"
+	return "SELECT redemptions_coupon.id, submissions.instagram_account, rewards.description, submissions.tier_name, redemptions_coupon.status, redemptions_coupon.max_uses - redemptions_coupon.use_count from public.redemptions_coupon join submissions on redemptions_coupon.submission_id = submissions.id join offers on submissions.offer_id = offers.id join rewards on submissions.loyalty_reward_id = rewards.id WHERE code = $1 AND offers.store_id = $2 AND offers.status = 'ACTIVE' AND redemptions_coupon.status = 'PENDING' AND current_timestamp < redemptions_coupon.expire_at"
 }
 
+// GenerateInstantQuery lists every instant reward a handle can redeem at a
+// store, soonest to expire first
 func GenerateInstantQuery() string {
-	return "SELECT submissions.id, submissions.instagram_account, rewards.description from submissions join offers on submissions.offer_id = offers.id join rewards on offers.instant_reward_id = rewards.id WHERE submissions.instagram_account = $1 AND submissions.status = 'ACCEPTED' AND current_timestamp < submissions.instant_reward_expire_at LIMIT 1"
+	return "SELECT submissions.id, submissions.instagram_account, rewards.description, submissions.tier_name, offers.id, actions.description, submissions.instant_reward_expire_at from submissions join offers on submissions.offer_id = offers.id join rewards on submissions.instant_reward_id = rewards.id join actions on offers.action_id = actions.id WHERE submissions.instagram_account = $1 AND offers.store_id = $2 AND offers.status = 'ACTIVE' AND submissions.status = 'ACCEPTED' AND current_timestamp < submissions.instant_reward_expire_at AND NOT EXISTS (SELECT 1 from redemptions_instant WHERE redemptions_instant.submission_id = submissions.id) ORDER BY submissions.instant_reward_expire_at, submissions.id"
+}
+
+// GenerateCouponIDQuery looks up a valid coupon by id, as named by a token
+func GenerateCouponIDQuery() string {
+	return "SELECT redemptions_coupon.id, submissions.instagram_account, rewards.description, submissions.tier_name, redemptions_coupon.status, redemptions_coupon.max_uses - redemptions_coupon.use_count from public.redemptions_coupon join submissions on redemptions_coupon.submission_id = submissions.id join offers on submissions.offer_id = offers.id join rewards on submissions.loyalty_reward_id = rewards.id WHERE redemptions_coupon.id = $1 AND offers.store_id = $2 AND offers.status = 'ACTIVE' AND redemptions_coupon.status = 'PENDING' AND current_timestamp < redemptions_coupon.expire_at"
+}
+
+// GenerateCouponCodeOwnerQuery looks up the store owning a valid coupon code
+// and the status of its offer, regardless of which store is asking or whether
+// the offer is paused. The calling store's own coupon comes first
+func GenerateCouponCodeOwnerQuery() string {
+	return "SELECT offers.store_id, offers.status from public.redemptions_coupon join submissions on redemptions_coupon.submission_id = submissions.id join offers on submissions.offer_id = offers.id WHERE code = $1 AND redemptions_coupon.status = 'PENDING' AND current_timestamp < redemptions_coupon.expire_at ORDER BY offers.store_id = $2 DESC LIMIT 1"
+}
+
+// GenerateCouponIDOwnerQuery does the same for a coupon named by a token
+func GenerateCouponIDOwnerQuery() string {
+	return "SELECT offers.store_id, offers.status from public.redemptions_coupon join submissions on redemptions_coupon.submission_id = submissions.id join offers on submissions.offer_id = offers.id WHERE redemptions_coupon.id = $1 AND redemptions_coupon.status = 'PENDING' AND current_timestamp < redemptions_coupon.expire_at ORDER BY offers.store_id = $2 DESC LIMIT 1"
+}
+
+// GenerateInstantOwnerQuery looks up the store owning a valid instant reward
+// and the status of its offer in the same way
+func GenerateInstantOwnerQuery() string {
+	return "SELECT offers.store_id, offers.status from submissions join offers on submissions.offer_id = offers.id WHERE submissions.instagram_account = $1 AND submissions.status = 'ACCEPTED' AND current_timestamp < submissions.instant_reward_expire_at AND NOT EXISTS (SELECT 1 from redemptions_instant WHERE redemptions_instant.submission_id = submissions.id) ORDER BY offers.store_id = $2 DESC LIMIT 1"
+}
+
+// ValidCoupon is the validate response for a coupon. Ids and counts are sent
+// as strings, as they always have been
+type ValidCoupon struct {
+	RedemptionID      int    `json:"redemptionID,string"`
+	InstagramAccount  string `json:"instagramAccount"`
+	RewardDescription string `json:"rewardDescription"`
+	TierName          string `json:"tierName"`
+	RedemptionStatus  string `json:"redemptionStatus"`
+	RemainingUses     int    `json:"remainingUses,string"`
+	StoreName         string `json:"storeName"`
+}
+
+// InstantReward is an instant reward a customer can redeem, identified by
+// its submission
+type InstantReward struct {
+	SubmissionID      string    `json:"submissionId"`
+	RewardDescription string    `json:"rewardDescription"`
+	TierName          string    `json:"tierName"`
+	OfferID           string    `json:"offerId"`
+	OfferDescription  string    `json:"offerDescription"`
+	ExpireAt          time.Time `json:"expireAt"`
+}
+
+// InstantRewards is the validate response for a handle. The top level fields
+// describe the soonest-expiring reward, as before there was a list
+type InstantRewards struct {
+	SubmissionID      string          `json:"submissionId"`
+	InstagramAccount  string          `json:"instagramAccount"`
+	RewardDescription string          `json:"rewardDescription"`
+	TierName          string          `json:"tierName"`
+	StoreName         string          `json:"storeName"`
+	Rewards           []InstantReward `json:"rewards"`
+}
+
+// eligibleInstantRewards lists the instant rewards a handle can redeem at a
+// store, soonest to expire first
+func eligibleInstantRewards(db *sql.DB, handle string, storeID int, storeName string) (InstantRewards, error) {
+	eligible := InstantRewards{InstagramAccount: handle, StoreName: storeName, Rewards: []InstantReward{}}
+	rows, err := db.Query(GenerateInstantQuery(), handle, storeID)
+	if err != nil {
+		return eligible, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var reward InstantReward
+		var tierName sql.NullString
+		if err = rows.Scan(&reward.SubmissionID, &eligible.InstagramAccount, &reward.RewardDescription, &tierName, &reward.OfferID, &reward.OfferDescription, &reward.ExpireAt); err != nil {
+			return eligible, err
+		}
+		reward.TierName = tierName.String
+		eligible.Rewards = append(eligible.Rewards, reward)
+	}
+	if len(eligible.Rewards) > 0 {
+		eligible.SubmissionID = eligible.Rewards[0].SubmissionID
+		eligible.RewardDescription = eligible.Rewards[0].RewardDescription
+		eligible.TierName = eligible.Rewards[0].TierName
+	}
+	return eligible, rows.Err()
+}
+
+// unavailable explains why the calling store found no valid redemption for a
+// code, using the owner query: it belongs to another store or its offer is
+// paused. It returns nil when there is no such redemption at all
+func unavailable(db *sql.DB, query string, code string, storeID int) (*Response, error) {
+	var ownerID int
+	var offerStatus string
+	switch err := db.QueryRow(query, code, storeID).Scan(&ownerID, &offerStatus); err {
+	case sql.ErrNoRows:
+		return nil, nil
+	case nil:
+	default:
+		return nil, err
+	}
+
+	var resp Response
+	switch {
+	case ownerID != storeID:
+		log.Printf("Error: Redemption code [%s] belongs to another store", code)
+		resp = errorResponse(403, "WRONG_STORE", "Redemption belongs to another store")
+	case offerStatus != "ACTIVE":
+		log.Printf("Error: Redemption code [%s] is for an inactive offer", code)
+		resp = errorResponse(422, "OFFER_INACTIVE", "Offer is no longer active")
+	default:
+		return nil, nil
+	}
+	return &resp, nil
+}
+
+// errorResponse builds an error response with a machine readable error code
+func errorResponse(statusCode int, code string, message string) Response {
+	return Response{StatusCode: statusCode,
+		Body: fmt.Sprintf(" { \"error\" : \"%s\", \"message\" : \"%s\" } ", code, message),
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin":      "*",
+			"Access-Control-Allow-Credentials": "true",
+		},
+	}
+}
+
+// Typo is the body of the error response for a mistyped coupon code
+type Typo struct {
+	Code       string `json:"error"`
+	Message    string `json:"message"`
+	Suggestion string `json:"suggestion,omitempty"`
+}
+
+// typoResponse builds the error response for a mistyped coupon code,
+// suggesting the intended code when a single transposition explains it
+func typoResponse(code string) (Response, error) {
+	typo := Typo{Code: "TYPO", Message: fmt.Sprintf("Code [%s] was mistyped", code)}
+	if suggestion, ok := coupon.Suggest(code); ok {
+		typo.Message = fmt.Sprintf("Code [%s] was mistyped, did you mean [%s]?", code, suggestion)
+		typo.Suggestion = suggestion
+	}
+	body, err := json.Marshal(typo)
+	if err != nil {
+		return Response{}, err
+	}
+	return Response{StatusCode: 400,
+		Body: string(body),
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin":      "*",
+			"Access-Control-Allow-Credentials": "true",
+		},
+	}, nil
+}
+
+// verifyToken checks a scanned token against the configured verify keys,
+// returning the error response to send when it does not hold up
+func verifyToken(payload string) (token.Claims, *Response) {
+	keys, err := token.VerifyKeysFromEnv()
+	if err != nil {
+		log.Printf("Error: %v", err)
+		return token.Claims{}, &Response{StatusCode: 500,
+			Headers: map[string]string{
+				"Access-Control-Allow-Origin":      "*",
+				"Access-Control-Allow-Credentials": "true",
+			},
+		}
+	}
+
+	claims, err := token.Verify(payload, keys, time.Now())
+	switch err {
+	case nil:
+		log.Printf("Info: Token verified for coupon [%d]", claims.CouponID)
+		return claims, nil
+	case token.ErrExpired:
+		log.Printf("Error: Token for coupon [%d] expired at %v", claims.CouponID, claims.ExpireAt)
+		resp := errorResponse(410, "EXPIRED", "Token has expired")
+		return claims, &resp
+	default:
+		log.Printf("Error: Token rejected: %v", err)
+		resp := errorResponse(400, "INVALID_TOKEN", "Token could not be verified")
+		return claims, &resp
+	}
 }
 
 // Handler is our lambda handler invoked by the `lambda.Start` function call
@@ -42,12 +231,48 @@ func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (Respon
 	redemptionType := request.QueryStringParameters["redemption_type"]
 	apiKey := request.QueryStringParameters["api_key"]
 
+	// A scanned QR payload carries a coupon code, the type is implied
+	if payloadCode, ok := coupon.ParsePayload(code); ok {
+		log.Printf("Info: Request code scanned from QR payload")
+		code = payloadCode
+		if redemptionType == "" {
+			redemptionType = "COUPON"
+		}
+	} else if token.IsToken(code) && redemptionType == "" {
+		log.Printf("Info: Request code scanned as a signed token")
+		redemptionType = "COUPON"
+	}
+
 	// Ensure all fields are not empty
 	if code != "" && redemptionType != "" && apiKey != "" {
 
 		log.Printf("Info: Request code %s", code)
 		log.Printf("Info: Request redemption type %s", redemptionType)
-		log.Printf("Info: Request API key %s", apiKey)
+		log.Printf("Info: Request API key %s", apikey.Visible(apiKey))
+
+		// Signed tokens are verified and coupon codes carry a check
+		// character, so bad ones are caught without looking them up
+		var claims *token.Claims
+		if redemptionType == "COUPON" && token.IsToken(code) {
+			verified, resp := verifyToken(code)
+			if resp != nil {
+				return *resp, nil
+			}
+			claims = &verified
+		} else if redemptionType == "COUPON" {
+			code = coupon.Normalize(code)
+			if coupon.Checked(code) && !coupon.Valid(code) {
+				log.Printf("Error: Redemption code [%s] failed its check character", code)
+				return typoResponse(code)
+			}
+		} else if redemptionType == "INSTANT" {
+			normalized, err := handle.Normalize(code)
+			if err != nil {
+				log.Printf("Error: Instagram handle [%s] is not valid", code)
+				return errorResponse(400, "INVALID_HANDLE", "Not a valid Instagram handle"), nil
+			}
+			code = normalized
+		}
 
 		// Connect to database
 		connStr := fmt.Sprintf("host=%s user=%s password=%s dbname=%s sslmode=disable",
@@ -68,12 +293,10 @@ func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (Respon
 		defer db.Close()
 
 		// Validate API key
-		var storeID int
-		var storeName string
-		row := db.QueryRow("SELECT id,name FROM stores WHERE api_key = $1", apiKey)
-		switch err = row.Scan(&storeID, &storeName); err {
-		case sql.ErrNoRows:
-			log.Printf("Error: No store with API key [%s] was found", apiKey)
+		storeID, storeName, err := apikey.Authenticate(db, apiKey)
+		switch err {
+		case apikey.ErrInvalid:
+			log.Printf("Error: No store with API key [%s] was found", apikey.Visible(apiKey))
 			return Response{StatusCode: 401,
 				Headers: map[string]string{
 					"Access-Control-Allow-Origin":      "*",
@@ -92,16 +315,40 @@ func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (Respon
 			}, nil
 		}
 
+		if claims != nil && claims.StoreID != storeID {
+			log.Printf("Error: Token for coupon [%d] belongs to another store", claims.CouponID)
+			return errorResponse(403, "WRONG_STORE", "Redemption belongs to another store"), nil
+		}
+
 		// Redeem a coupon code
 		if redemptionType == "COUPON" {
 			log.Printf("Info: Validating redemption type [%s]", redemptionType)
-			var redemptionID int
-			var instagramAccount string
-			var rewardDescription string
-			var redemptionStatus string
-			row := db.QueryRow(GenerateCouponCodeQuery(), code)
-			switch err = row.Scan(&redemptionID, &instagramAccount, &rewardDescription, &redemptionStatus); err {
+			valid := ValidCoupon{StoreName: storeName}
+			var tierName sql.NullString
+			query, key := GenerateCouponCodeQuery(), code
+			if claims != nil {
+				query, key = GenerateCouponIDQuery(), strconv.Itoa(claims.CouponID)
+			}
+			row := db.QueryRow(query, key, storeID)
+			switch err = row.Scan(&valid.RedemptionID, &valid.InstagramAccount, &valid.RewardDescription, &tierName, &valid.RedemptionStatus, &valid.RemainingUses); err {
 			case sql.ErrNoRows:
+				query = GenerateCouponCodeOwnerQuery()
+				if claims != nil {
+					query = GenerateCouponIDOwnerQuery()
+				}
+				resp, err := unavailable(db, query, key, storeID)
+				if err != nil {
+					log.Printf("Error: %v", err)
+					return Response{StatusCode: 500,
+						Headers: map[string]string{
+							"Access-Control-Allow-Origin":      "*",
+							"Access-Control-Allow-Credentials": "true",
+						},
+					}, nil
+				}
+				if resp != nil {
+					return *resp, nil
+				}
 				log.Printf("Error: Redemption code [%s] NOT FOUND", code)
 				return Response{StatusCode: 404,
 					Headers: map[string]string{
@@ -112,12 +359,23 @@ func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (Respon
 			case nil:
 				log.Printf("Success: Redemption code [%s] FOUND", code)
 
+				valid.TierName = tierName.String
+
 				//Generate message that want to be sent as body
-				message := fmt.Sprintf(" { \"redemptionID\" : \"%d\", \"instagramAccount\" : \"%s\", \"rewardDescription\" : \"%s\", \"redemptionStatus\" : \"%s\", \"storeName\" : \"%s\" } ", redemptionID, instagramAccount, rewardDescription, redemptionStatus, storeName)
+				message, err := json.Marshal(valid)
+				if err != nil {
+					log.Printf("Error: %v", err)
+					return Response{StatusCode: 500,
+						Headers: map[string]string{
+							"Access-Control-Allow-Origin":      "*",
+							"Access-Control-Allow-Credentials": "true",
+						},
+					}, nil
+				}
 
 				//Returning response with AWS Lambda Proxy Response
 				return Response{StatusCode: 200,
-					Body: message,
+					Body: string(message),
 					Headers: map[string]string{
 						"Access-Control-Allow-Origin":      "*",
 						"Access-Control-Allow-Credentials": "true",
@@ -135,35 +393,45 @@ func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (Respon
 			}
 		} else if redemptionType == "INSTANT" {
 			log.Printf("Info: Validating redemption type [%s]", redemptionType)
-			var submissionID int
-			var instagramAccount string
-			var rewardDescription string
-			row := db.QueryRow(GenerateInstantQuery(), code)
-			switch err = row.Scan(&submissionID, &instagramAccount, &rewardDescription); err {
-			case sql.ErrNoRows:
-				log.Printf("Error: Redemption code [%s] NOT FOUND", code)
-				return Response{StatusCode: 404,
+			eligible, err := eligibleInstantRewards(db, code, storeID, storeName)
+			if err != nil {
+				log.Printf("Error: %v", err)
+				return Response{StatusCode: 500,
 					Headers: map[string]string{
 						"Access-Control-Allow-Origin":      "*",
 						"Access-Control-Allow-Credentials": "true",
 					},
 				}, nil
-			case nil:
-				log.Printf("Success: Redemption code [%s] FOUND", code)
-
-				//Generate message that want to be sent as body
-				message := fmt.Sprintf(" { \"submissionId\" : \"%d\", \"instagramAccount\" : \"%s\", \"rewardDescription\" : \"%s\",  \"storeName\" : \"%s\" } ", submissionID, instagramAccount, rewardDescription, storeName)
+			}
 
-				//Returning response with AWS Lambda Proxy Response
-				return Response{StatusCode: 200,
-					Body: message,
+			if len(eligible.Rewards) == 0 {
+				resp, err := unavailable(db, GenerateInstantOwnerQuery(), code, storeID)
+				if err != nil {
+					log.Printf("Error: %v", err)
+					return Response{StatusCode: 500,
+						Headers: map[string]string{
+							"Access-Control-Allow-Origin":      "*",
+							"Access-Control-Allow-Credentials": "true",
+						},
+					}, nil
+				}
+				if resp != nil {
+					return *resp, nil
+				}
+				log.Printf("Error: Redemption code [%s] NOT FOUND", code)
+				return Response{StatusCode: 404,
 					Headers: map[string]string{
 						"Access-Control-Allow-Origin":      "*",
 						"Access-Control-Allow-Credentials": "true",
 					},
 				}, nil
+			}
 
-			default:
+			log.Printf("Success: Redemption code [%s] FOUND %d eligible rewards", code, len(eligible.Rewards))
+
+			//Generate message that want to be sent as body
+			message, err := json.Marshal(eligible)
+			if err != nil {
 				log.Printf("Error: %v", err)
 				return Response{StatusCode: 500,
 					Headers: map[string]string{
@@ -172,6 +440,15 @@ func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (Respon
 					},
 				}, nil
 			}
+
+			//Returning response with AWS Lambda Proxy Response
+			return Response{StatusCode: 200,
+				Body: string(message),
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
 		} else {
 			log.Printf("Error: Invalid redemption type [%s]", redemptionType)
 			return Response{StatusCode: 400,
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/addauda/bubble-rewards-storefront-api/apikey"
+	"github.com/addauda/bubble-rewards-storefront-api/coupon"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/lib/pq"
+)
+
+// Response is of type APIGatewayProxyResponse since we're leveraging the
+// AWS Lambda Proxy Request functionality (default behavior)
+//
+// https://serverless.com/framework/docs/providers/aws/events/apigateway/#lambda-proxy-integration
+type Response events.APIGatewayProxyResponse
+
+const expiration = time.Hour
+
+// defaultVoidWindow applies when VOID_WINDOW_MINUTES is not set
+const defaultVoidWindow = 15 * time.Minute
+
+// maxRecodeAttempts is how many codes a voided coupon tries before giving up
+const maxRecodeAttempts = 5
+
+// uniqueViolation is the Postgres error code for a unique index violation
+const uniqueViolation = "23505"
+
+var client = &http.Client{}
+
+// reasons are the accepted void reason codes
+var reasons = map[string]bool{
+	"WRONG_REDEMPTION": true,
+	"WRONG_CUSTOMER":   true,
+	"DUPLICATE":        true,
+	"CUSTOMER_REQUEST": true,
+	"OTHER":            true,
+}
+
+// VoidRequest is the body of a void
+type VoidRequest struct {
+	ID             json.Number `json:"id"`
+	RedemptionType string      `json:"redemption_type"`
+	Reason         string      `json:"reason"`
+	Note           string      `json:"note"`
+	VoidedBy       string      `json:"voided_by"`
+}
+
+// Refusal explains why a void was refused
+type Refusal struct {
+	StatusCode int    `json:"-"`
+	Code       string `json:"error"`
+	Message    string `json:"message"`
+}
+
+// GenerateLockRedeemedCouponQuery reads a coupon with its use count, last
+// redemption time and owning store, locking the coupon row
+func GenerateLockRedeemedCouponQuery() string {
+	return "SELECT redemptions_coupon.use_count, redemptions_coupon.redeemed_at, redemptions_coupon.submission_id, offers.store_id from redemptions_coupon join submissions on redemptions_coupon.submission_id = submissions.id join offers on submissions.offer_id = offers.id WHERE redemptions_coupon.id = $1 FOR UPDATE OF redemptions_coupon"
+}
+
+// GenerateLockRedeemedSubmissionQuery reads a submission with its instant
+// redemption time and owning store, locking the submission row
+func GenerateLockRedeemedSubmissionQuery() string {
+	return "SELECT redemptions_instant.id, redemptions_instant.redeemed_at, offers.store_id from submissions join offers on submissions.offer_id = offers.id left join redemptions_instant on redemptions_instant.submission_id = submissions.id WHERE submissions.id = $1 FOR UPDATE OF submissions"
+}
+
+// GenerateVoidCouponUseQuery removes the latest logged use of a coupon
+func GenerateVoidCouponUseQuery() string {
+	return "DELETE FROM redemptions_coupon_uses WHERE id = (SELECT id from redemptions_coupon_uses WHERE coupon_id = $1 ORDER BY redeemed_at DESC, id DESC LIMIT 1)"
+}
+
+// GenerateVoidCouponQuery gives a use back to a coupon and returns it to
+// PENDING, rewinding redeemed_at to the previous use if there is one. The
+// coupon is given code $2 instead of its own when it is set
+func GenerateVoidCouponQuery() string {
+	return "UPDATE redemptions_coupon SET use_count = use_count - 1, status = 'PENDING', redeemed_at = (SELECT max(redeemed_at) from redemptions_coupon_uses WHERE coupon_id = $1), code = COALESCE($2, code) WHERE id = $1 AND use_count > 0"
+}
+
+// GenerateVoidInstantQuery removes the instant redemption claim on a
+// submission
+func GenerateVoidInstantQuery() string {
+	return "DELETE FROM redemptions_instant WHERE submission_id = $1"
+}
+
+// GenerateRecordVoidQuery records who voided a redemption, with which API
+// key, and why
+func GenerateRecordVoidQuery() string {
+	return "INSERT INTO redemption_voids (redemption_type, coupon_id, submission_id, redeemed_at, reason, note, voided_by, store_id, api_key_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id, voided_at"
+}
+
+// voidWindow reads the configured grace window for voids
+func voidWindow() time.Duration {
+	minutes, err := strconv.Atoi(os.Getenv("VOID_WINDOW_MINUTES"))
+	if err != nil || minutes <= 0 {
+		return defaultVoidWindow
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// refuse checks a locked redemption against the calling store and the void
+// window and returns the reason it cannot be voided, or nil when it can
+func refuse(storeID int, ownerID int, redeemedAt sql.NullTime, window time.Duration) *Refusal {
+	switch {
+	case ownerID != storeID:
+		return &Refusal{StatusCode: 403, Code: "WRONG_STORE", Message: "Redemption belongs to another store"}
+	case !redeemedAt.Valid:
+		return &Refusal{StatusCode: 409, Code: "NOT_REDEEMED", Message: "Redemption has not been redeemed"}
+	case time.Since(redeemedAt.Time) > window:
+		return &Refusal{StatusCode: 422, Code: "VOID_WINDOW_CLOSED", Message: fmt.Sprintf("Redemptions can only be voided within %v", window)}
+	}
+	return nil
+}
+
+// restoreCoupon returns a coupon to PENDING within tx. Another pending coupon
+// may have been issued the same code since this one was redeemed, in which
+// case the coupon is given a fresh code, returned as recoded
+func restoreCoupon(tx *sql.Tx, id int) (string, *Refusal, error) {
+	if _, err := tx.Exec("SAVEPOINT void_coupon"); err != nil {
+		return "", nil, err
+	}
+
+	var recoded sql.NullString
+	for attempt := 0; attempt < maxRecodeAttempts; attempt++ {
+		_, err := tx.Exec(GenerateVoidCouponQuery(), id, recoded)
+		if pqErr, ok := err.(*pq.Error); !ok || pqErr.Code != uniqueViolation {
+			return recoded.String, nil, err
+		}
+
+		log.Printf("Info: Code of coupon [%d] is held by another pending coupon", id)
+		if _, err = tx.Exec("ROLLBACK TO SAVEPOINT void_coupon"); err != nil {
+			return "", nil, err
+		}
+		code, err := coupon.NewCode(coupon.Length())
+		if err != nil {
+			return "", nil, err
+		}
+		recoded = sql.NullString{String: code, Valid: true}
+	}
+	return "", &Refusal{StatusCode: 409, Code: "CODE_IN_USE", Message: "Coupon code is held by another coupon"}, nil
+}
+
+// voidCoupon locks the coupon, checks that the calling store may void it and
+// gives back its latest use, all within tx
+func voidCoupon(tx *sql.Tx, id int, caller apikey.Caller, body VoidRequest) (string, *Refusal, error) {
+	var useCount int
+	var redeemedAt sql.NullTime
+	var submissionID int
+	var ownerID int
+	row := tx.QueryRow(GenerateLockRedeemedCouponQuery(), id)
+	switch err := row.Scan(&useCount, &redeemedAt, &submissionID, &ownerID); err {
+	case sql.ErrNoRows:
+		return "", &Refusal{StatusCode: 404, Code: "NOT_FOUND", Message: "Coupon not found"}, nil
+	case nil:
+	default:
+		return "", nil, err
+	}
+
+	if useCount == 0 {
+		redeemedAt.Valid = false
+	}
+	if refusal := refuse(caller.StoreID, ownerID, redeemedAt, voidWindow()); refusal != nil {
+		return "", refusal, nil
+	}
+
+	if _, err := tx.Exec(GenerateVoidCouponUseQuery(), id); err != nil {
+		return "", nil, err
+	}
+	recoded, refusal, err := restoreCoupon(tx, id)
+	if err != nil || refusal != nil {
+		return "", refusal, err
+	}
+	return recordVoid(tx, "COUPON", sql.NullInt64{Int64: int64(id), Valid: true}, recoded, submissionID, redeemedAt, caller, body)
+}
+
+// voidInstant locks the submission, checks that the calling store may void
+// its instant redemption and removes the claim, all within tx
+func voidInstant(tx *sql.Tx, id int, caller apikey.Caller, body VoidRequest) (string, *Refusal, error) {
+	var redemptionID sql.NullInt64
+	var redeemedAt sql.NullTime
+	var ownerID int
+	row := tx.QueryRow(GenerateLockRedeemedSubmissionQuery(), id)
+	switch err := row.Scan(&redemptionID, &redeemedAt, &ownerID); err {
+	case sql.ErrNoRows:
+		return "", &Refusal{StatusCode: 404, Code: "NOT_FOUND", Message: "Submission not found"}, nil
+	case nil:
+	default:
+		return "", nil, err
+	}
+
+	if !redemptionID.Valid {
+		redeemedAt.Valid = false
+	}
+	if refusal := refuse(caller.StoreID, ownerID, redeemedAt, voidWindow()); refusal != nil {
+		return "", refusal, nil
+	}
+
+	if _, err := tx.Exec(GenerateVoidInstantQuery(), id); err != nil {
+		return "", nil, err
+	}
+	return recordVoid(tx, "INSTANT", sql.NullInt64{}, "", id, redeemedAt, caller, body)
+}
+
+// recordVoid logs the void against the key that made it and generates the
+// response body, carrying the coupon's new code when it had to be recoded
+func recordVoid(tx *sql.Tx, redemptionType string, couponID sql.NullInt64, recoded string, submissionID int, redeemedAt sql.NullTime, caller apikey.Caller, body VoidRequest) (string, *Refusal, error) {
+	var voidID int
+	var voidTime string
+	row := tx.QueryRow(GenerateRecordVoidQuery(), redemptionType, couponID, submissionID, redeemedAt, body.Reason, body.Note, body.VoidedBy, caller.StoreID, caller.KeyID)
+	if err := row.Scan(&voidID, &voidTime); err != nil {
+		return "", nil, err
+	}
+	log.Printf("Success: Voided %s redemption of submission [%d] with key [%d]", redemptionType, submissionID, caller.KeyID)
+
+	//Generate message that want to be sent as body
+	if recoded != "" {
+		return fmt.Sprintf(" { \"voidID\" : \"%d\", \"redemptionType\" : \"%s\", \"submissionId\" : \"%d\", \"reason\" : \"%s\", \"voidTime\" : \"%s\", \"code\" : \"%s\" } ", voidID, redemptionType, submissionID, body.Reason, voidTime, recoded), nil, nil
+	}
+	return fmt.Sprintf(" { \"voidID\" : \"%d\", \"redemptionType\" : \"%s\", \"submissionId\" : \"%d\", \"reason\" : \"%s\", \"voidTime\" : \"%s\" } ", voidID, redemptionType, submissionID, body.Reason, voidTime), nil, nil
+}
+
+// refusalResponse builds an error response with a machine readable error code
+func refusalResponse(refusal *Refusal) (Response, error) {
+	body, err := json.Marshal(refusal)
+	if err != nil {
+		return Response{}, err
+	}
+	return Response{StatusCode: refusal.StatusCode,
+		Body: string(body),
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin":      "*",
+			"Access-Control-Allow-Credentials": "true",
+		},
+	}, nil
+}
+
+// Handler is our lambda handler invoked by the `lambda.Start` function call
+func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (Response, error) {
+
+	apiKey := request.QueryStringParameters["api_key"]
+
+	var body VoidRequest
+	if err := json.Unmarshal([]byte(request.Body), &body); err != nil {
+		log.Printf("Error: Malformed request body: %v", err)
+		return Response{StatusCode: 400,
+			Headers: map[string]string{
+				"Access-Control-Allow-Origin":      "*",
+				"Access-Control-Allow-Credentials": "true",
+			},
+		}, nil
+	}
+	id := body.ID.String()
+
+	// Ensure all fields are not empty
+	if id != "" && body.RedemptionType != "" && body.Reason != "" && body.VoidedBy != "" && apiKey != "" {
+
+		log.Printf("Info: Request id %s", id)
+		log.Printf("Info: Request redemption type %s", body.RedemptionType)
+		log.Printf("Info: Request reason %s", body.Reason)
+		log.Printf("Info: Request voided by %s", body.VoidedBy)
+		log.Printf("Info: Request API key %s", apikey.Visible(apiKey))
+
+		if body.RedemptionType != "COUPON" && body.RedemptionType != "INSTANT" {
+			log.Printf("Error: Invalid redemption type [%s]", body.RedemptionType)
+			return Response{StatusCode: 400,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		if !reasons[body.Reason] {
+			log.Printf("Error: Invalid void reason [%s]", body.Reason)
+			return Response{StatusCode: 400,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		redemptionID, err := strconv.ParseInt(id, 10, 32)
+		if err != nil || redemptionID < 1 {
+			log.Printf("Error: Invalid id [%s]", id)
+			return refusalResponse(&Refusal{StatusCode: 400, Code: "INVALID_ID", Message: "Id must be a positive integer"})
+		}
+
+		// Connect to database
+		connStr := fmt.Sprintf("host=%s user=%s password=%s dbname=%s sslmode=disable",
+			os.Getenv("DB_HOST"), os.Getenv("DB_USER"), os.Getenv("DB_PASSWORD"), os.Getenv("DB_NAME"))
+
+		db, err := sql.Open("postgres", connStr)
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		defer db.Close()
+
+		// Validate API key, remembering which key voids are made with
+		caller, err := apikey.Identify(db, apiKey)
+		switch err {
+		case apikey.ErrInvalid:
+			log.Printf("Error: No store with API key [%s] was found", apikey.Visible(apiKey))
+			return Response{StatusCode: 401,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		case nil:
+			log.Printf("Info: Retreived store as [%s]", caller.StoreName)
+		default:
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		// Check and void within one transaction so the redemption cannot
+		// change underneath us
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		var message string
+		var refusal *Refusal
+		if body.RedemptionType == "COUPON" {
+			message, refusal, err = voidCoupon(tx, int(redemptionID), caller, body)
+		} else {
+			message, refusal, err = voidInstant(tx, int(redemptionID), caller, body)
+		}
+
+		if err == nil && refusal == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		if refusal != nil {
+			log.Printf("Error: Void of [%s] refused as [%s]", id, refusal.Code)
+			return refusalResponse(refusal)
+		}
+
+		//Returning response with AWS Lambda Proxy Response
+		return Response{StatusCode: 200,
+			Body: message,
+			Headers: map[string]string{
+				"Access-Control-Allow-Origin":      "*",
+				"Access-Control-Allow-Credentials": "true",
+			},
+		}, nil
+	}
+
+	// Missing one of required parameters
+	log.Printf("Error: Request missing a required parameter")
+	return Response{StatusCode: 400,
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin":      "*",
+			"Access-Control-Allow-Credentials": "true",
+		},
+	}, nil
+}
+
+type LocalServer struct{}
+
+func (l *LocalServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("Error reading request body: %v", err)
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("Failed to write body: %v", err)))
+		return
+	}
+
+	url, err := url.Parse(r.URL.String())
+	if err != nil {
+		log.Printf("Error parsing query string: %v", err)
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("Malformed query string: %v", err)))
+		return
+	}
+	queryParams := url.Query()
+
+	//**building request**
+	req := events.APIGatewayProxyRequest{
+		Body:                  string(body),
+		Headers:               make(map[string]string),
+		HTTPMethod:            r.Method,
+		Path:                  r.URL.Path,
+		QueryStringParameters: make(map[string]string),
+	}
+
+	//map raw request headers
+	for k, v := range r.Header {
+		req.Headers[strings.ToLower(k)] = v[0]
+	}
+
+	//Map raw query params
+	for k, v := range queryParams {
+		req.QueryStringParameters[strings.ToLower(k)] = v[0]
+	}
+
+	resp, err := Handler(r.Context(), req)
+	if err != nil {
+		log.Printf("Error handling request: %v", err)
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("Error handling request: %v", err)))
+		return
+	}
+	for k, v := range resp.Headers {
+		w.Header().Add(k, v)
+	}
+	(w).Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(resp.StatusCode)
+	w.Write([]byte(resp.Body))
+}
+
+func local() {
+	server := &LocalServer{}
+	fmt.Println("Starting local dev server on :8080")
+	http.ListenAndServe(":8080", server)
+}
+
+func main() {
+	if os.Getenv("AWS_LAMBDA_FUNCTION_NAME") == "" {
+		//see local creds file for env vars
+		local()
+	} else {
+		// Make the handler available for Remote Procedure Call by AWS Lambda
+		lambda.Start(Handler)
+	}
+}
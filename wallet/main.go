@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/addauda/bubble-rewards-storefront-api/apikey"
+	"github.com/addauda/bubble-rewards-storefront-api/handle"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	_ "github.com/lib/pq"
+)
+
+// Response is of type APIGatewayProxyResponse since we're leveraging the
+// AWS Lambda Proxy Request functionality (default behavior)
+//
+// https://serverless.com/framework/docs/providers/aws/events/apigateway/#lambda-proxy-integration
+type Response events.APIGatewayProxyResponse
+
+const expiration = time.Hour
+
+var client = &http.Client{}
+
+// WalletItem is a coupon or instant reward a customer holds at a store
+type WalletItem struct {
+	RedemptionType string    `json:"redemptionType"`
+	ID             string    `json:"id"`
+	Description    string    `json:"rewardDescription"`
+	TierName       string    `json:"tierName,omitempty"`
+	Status         string    `json:"status"`
+	ExpireAt       time.Time `json:"expireAt"`
+	Code           string    `json:"code,omitempty"`
+	RemainingUses  *int      `json:"remainingUses,omitempty"`
+}
+
+// Wallet is everything a customer can redeem at a store
+type Wallet struct {
+	InstagramAccount string       `json:"instagramAccount"`
+	StoreName        string       `json:"storeName"`
+	Items            []WalletItem `json:"items"`
+}
+
+// GenerateWalletQuery lists a handle's pending coupons and unredeemed instant
+// rewards from a store's active offers, soonest to expire first
+func GenerateWalletQuery() string {
+	return "SELECT 'COUPON', redemptions_coupon.id, rewards.description, submissions.tier_name, redemptions_coupon.status::text, redemptions_coupon.expire_at, redemptions_coupon.code, redemptions_coupon.max_uses - redemptions_coupon.use_count from redemptions_coupon join submissions on redemptions_coupon.submission_id = submissions.id join offers on submissions.offer_id = offers.id join rewards on submissions.loyalty_reward_id = rewards.id WHERE submissions.instagram_account = $1 AND offers.store_id = $2 AND offers.status = 'ACTIVE' AND redemptions_coupon.status = 'PENDING' AND current_timestamp < redemptions_coupon.expire_at " +
+		"UNION ALL SELECT 'INSTANT', submissions.id, rewards.description, submissions.tier_name, submissions.status::text, submissions.instant_reward_expire_at, NULL, NULL from submissions join offers on submissions.offer_id = offers.id join rewards on submissions.instant_reward_id = rewards.id WHERE submissions.instagram_account = $1 AND offers.store_id = $2 AND offers.status = 'ACTIVE' AND submissions.status = 'ACCEPTED' AND current_timestamp < submissions.instant_reward_expire_at AND NOT EXISTS (SELECT 1 from redemptions_instant WHERE redemptions_instant.submission_id = submissions.id) " +
+		"ORDER BY 6, 1, 2"
+}
+
+// errorResponse builds an error response with a machine readable error code
+func errorResponse(statusCode int, code string, message string) Response {
+	return Response{StatusCode: statusCode,
+		Body: fmt.Sprintf(" { \"error\" : \"%s\", \"message\" : \"%s\" } ", code, message),
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin":      "*",
+			"Access-Control-Allow-Credentials": "true",
+		},
+	}
+}
+
+// lookupWallet gathers everything a handle can redeem at a store
+func lookupWallet(db *sql.DB, instagramAccount string, storeID int, storeName string) (Wallet, error) {
+	wallet := Wallet{InstagramAccount: instagramAccount, StoreName: storeName, Items: []WalletItem{}}
+	rows, err := db.Query(GenerateWalletQuery(), instagramAccount, storeID)
+	if err != nil {
+		return wallet, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item WalletItem
+		var code sql.NullString
+		var remainingUses sql.NullInt64
+		var tierName sql.NullString
+		if err = rows.Scan(&item.RedemptionType, &item.ID, &item.Description, &tierName, &item.Status, &item.ExpireAt, &code, &remainingUses); err != nil {
+			return wallet, err
+		}
+		item.Code = code.String
+		item.TierName = tierName.String
+		if remainingUses.Valid {
+			uses := int(remainingUses.Int64)
+			item.RemainingUses = &uses
+		}
+		wallet.Items = append(wallet.Items, item)
+	}
+	return wallet, rows.Err()
+}
+
+// Handler is our lambda handler invoked by the `lambda.Start` function call
+func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (Response, error) {
+
+	instagramAccount := request.QueryStringParameters["handle"]
+	apiKey := request.QueryStringParameters["api_key"]
+
+	// Ensure all fields are not empty
+	if instagramAccount != "" && apiKey != "" {
+
+		log.Printf("Info: Request handle %s", instagramAccount)
+		log.Printf("Info: Request API key %s", apikey.Visible(apiKey))
+
+		normalized, err := handle.Normalize(instagramAccount)
+		if err != nil {
+			log.Printf("Error: Instagram handle [%s] is not valid", instagramAccount)
+			return errorResponse(400, "INVALID_HANDLE", "Not a valid Instagram handle"), nil
+		}
+		instagramAccount = normalized
+
+		// Connect to database
+		connStr := fmt.Sprintf("host=%s user=%s password=%s dbname=%s sslmode=disable",
+			os.Getenv("DB_HOST"), os.Getenv("DB_USER"), os.Getenv("DB_PASSWORD"), os.Getenv("DB_NAME"))
+
+		db, err := sql.Open("postgres", connStr)
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		defer db.Close()
+
+		// Validate API key
+		storeID, storeName, err := apikey.Authenticate(db, apiKey)
+		switch err {
+		case apikey.ErrInvalid:
+			log.Printf("Error: No store with API key [%s] was found", apikey.Visible(apiKey))
+			return Response{StatusCode: 401,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		case nil:
+			log.Printf("Info: Retreived store as [%s]", storeName)
+		default:
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		wallet, err := lookupWallet(db, instagramAccount, storeID, storeName)
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+		log.Printf("Success: Handle [%s] holds %d rewards", instagramAccount, len(wallet.Items))
+
+		//Generate message that want to be sent as body
+		message, err := json.Marshal(wallet)
+		if err != nil {
+			log.Printf("Error: %v", err)
+			return Response{StatusCode: 500,
+				Headers: map[string]string{
+					"Access-Control-Allow-Origin":      "*",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, nil
+		}
+
+		//Returning response with AWS Lambda Proxy Response
+		return Response{StatusCode: 200,
+			Body: string(message),
+			Headers: map[string]string{
+				"Access-Control-Allow-Origin":      "*",
+				"Access-Control-Allow-Credentials": "true",
+			},
+		}, nil
+	}
+
+	// Missing one of required parameters
+	log.Printf("Error: Request missing a required parameter")
+	return Response{StatusCode: 400,
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin":      "*",
+			"Access-Control-Allow-Credentials": "true",
+		},
+	}, nil
+}
+
+type LocalServer struct{}
+
+func (l *LocalServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("Error reading request body: %v", err)
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("Failed to write body: %v", err)))
+		return
+	}
+
+	url, err := url.Parse(r.URL.String())
+	if err != nil {
+		log.Printf("Error parsing query string: %v", err)
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("Malformed query string: %v", err)))
+		return
+	}
+	queryParams := url.Query()
+
+	//**building request**
+	req := events.APIGatewayProxyRequest{
+		Body:                  string(body),
+		Headers:               make(map[string]string),
+		HTTPMethod:            r.Method,
+		Path:                  r.URL.Path,
+		QueryStringParameters: make(map[string]string),
+	}
+
+	//map raw request headers
+	for k, v := range r.Header {
+		req.Headers[strings.ToLower(k)] = v[0]
+	}
+
+	//Map raw query params
+	for k, v := range queryParams {
+		req.QueryStringParameters[strings.ToLower(k)] = v[0]
+	}
+
+	resp, err := Handler(r.Context(), req)
+	if err != nil {
+		log.Printf("Error handling request: %v", err)
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("Error handling request: %v", err)))
+		return
+	}
+	for k, v := range resp.Headers {
+		w.Header().Add(k, v)
+	}
+	(w).Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(resp.StatusCode)
+	w.Write([]byte(resp.Body))
+}
+
+func local() {
+	server := &LocalServer{}
+	fmt.Println("Starting local dev server on :8080")
+	http.ListenAndServe(":8080", server)
+}
+
+func main() {
+	if os.Getenv("AWS_LAMBDA_FUNCTION_NAME") == "" {
+		//see local creds file for env vars
+		local()
+	} else {
+		// Make the handler available for Remote Procedure Call by AWS Lambda
+		lambda.Start(Handler)
+	}
+}